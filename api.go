@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/go-alfred"
+)
+
+// ApiAddress is the default listen address. The API can change settings, so
+// it's only served on the loopback interface unless another address is given.
+const ApiAddress = "127.0.0.1:9143"
+
+// api ---------------------------------------------------
+
+type ApiCommand struct{}
+
+func (c ApiCommand) Keyword() string {
+	return "api"
+}
+
+func (c ApiCommand) IsEnabled() bool {
+	return isAuthorized()
+}
+
+func (c ApiCommand) MenuItem() alfred.Item {
+	return alfred.Item{
+		Title:        c.Keyword(),
+		Autocomplete: c.Keyword(),
+		Arg:          "api",
+		SubtitleAll:  "Serve a local REST API on " + ApiAddress,
+	}
+}
+
+func (c ApiCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	items = append(items, c.MenuItem())
+	if config.ApiToken != "" {
+		items = append(items, alfred.Item{
+			Title:       "Bearer token",
+			SubtitleAll: config.ApiToken,
+			Arg:         config.ApiToken,
+			Valid:       alfred.Invalid,
+		})
+	}
+	return
+}
+
+// Do starts the API server. The listen address may be given as the query; it
+// defaults to ApiAddress.
+func (c ApiCommand) Do(query string) (string, error) {
+	addr := strings.TrimSpace(query)
+	if addr == "" {
+		addr = ApiAddress
+	}
+	return "", StartApiServer(addr)
+}
+
+// StartApiServer serves the local REST API on the given address. A bearer
+// token is generated and saved to the config the first time the server runs.
+func StartApiServer(addr string) error {
+	if config.ApiToken == "" {
+		err := updateConfig(func(c *Config) (err error) {
+			if c.ApiToken == "" {
+				c.ApiToken, err = newApiToken()
+			}
+			return
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/thermostats", apiHandler(apiThermostats))
+	mux.HandleFunc("/thermostats/", apiHandler(apiThermostat))
+	mux.HandleFunc("/structures", apiHandler(apiStructures))
+	mux.HandleFunc("/structures/", apiHandler(apiStructure))
+
+	writeOrigin = OriginApi
+	log.Println("Serving API on", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func newApiToken() (string, error) {
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randBytes), nil
+}
+
+// apiError is an error with an associated HTTP status code.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e apiError) Error() string {
+	return e.message
+}
+
+var errNotFound = apiError{http.StatusNotFound, "Not found"}
+var errMethod = apiError{http.StatusMethodNotAllowed, "Method not allowed"}
+
+// apiLock serializes API requests, since they read and update the global
+// cache.
+var apiLock sync.Mutex
+
+// apiHandler wraps an endpoint with bearer token authentication and JSON
+// encoding of its result.
+func apiHandler(endpoint func(r *http.Request, path []string) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		expected := "Bearer " + config.ApiToken
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(expected)) != 1 {
+			writeApiError(w, apiError{http.StatusUnauthorized, "Invalid or missing bearer token"})
+			return
+		}
+
+		apiLock.Lock()
+		defer apiLock.Unlock()
+
+		var path []string
+		for _, p := range strings.Split(strings.Trim(r.URL.Path, "/"), "/") {
+			if p != "" {
+				path = append(path, p)
+			}
+		}
+
+		result, err := endpoint(r, path)
+		if err != nil {
+			writeApiError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func writeApiError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(apiError); ok {
+		status = e.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// refreshApiCache refreshes the cache if it's stale. As in the Alfred
+// commands, a failed refresh falls back to the cached data when there is some.
+func refreshApiCache() error {
+	err := checkRefreshNow()
+	if err != nil && hasCachedData() {
+		return nil
+	}
+	return err
+}
+
+// apiTarget is the result of setting a target temperature.
+type apiTarget struct {
+	Temperature float64        `json:"temperature"`
+	Scale       nest.TempScale `json:"scale"`
+	Queued      bool           `json:"queued"`
+}
+
+// apiMode is the result of setting a thermostat's mode.
+type apiMode struct {
+	Mode   nest.HvacMode `json:"mode"`
+	Queued bool          `json:"queued"`
+}
+
+// apiPresence is the result of setting a structure's presence.
+type apiPresence struct {
+	Presence nest.Presence `json:"presence"`
+	Queued   bool          `json:"queued"`
+}
+
+func decodeApiBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return apiError{http.StatusBadRequest, "Invalid request body: " + err.Error()}
+	}
+	return nil
+}
+
+// GET /thermostats
+func apiThermostats(r *http.Request, path []string) (interface{}, error) {
+	if r.Method != "GET" {
+		return nil, errMethod
+	}
+	if err := refreshApiCache(); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for id := range cache.AllData.Devices.Thermostats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	thermostats := []nest.Thermostat{}
+	for _, id := range ids {
+		thermostats = append(thermostats, cache.AllData.Devices.Thermostats[id])
+	}
+	return thermostats, nil
+}
+
+// GET /thermostats/{id}
+// PUT /thermostats/{id}/target
+// PUT /thermostats/{id}/mode
+func apiThermostat(r *http.Request, path []string) (interface{}, error) {
+	if len(path) < 2 || len(path) > 3 {
+		return nil, errNotFound
+	}
+	if err := refreshApiCache(); err != nil {
+		return nil, err
+	}
+
+	thermostat, ok := cache.AllData.Devices.Thermostats[path[1]]
+	if !ok {
+		return nil, errNotFound
+	}
+
+	if len(path) == 2 {
+		if r.Method != "GET" {
+			return nil, errMethod
+		}
+		return thermostat, nil
+	}
+
+	if r.Method != "PUT" {
+		return nil, errMethod
+	}
+
+	switch path[2] {
+	case "target":
+		var body struct {
+			Temperature float64        `json:"temperature"`
+			Scale       nest.TempScale `json:"scale"`
+			Type        nest.HighLow   `json:"type"`
+		}
+		if err := decodeApiBody(r, &body); err != nil {
+			return nil, err
+		}
+		if body.Scale == "" {
+			body.Scale = config.Scale
+		}
+		if body.Scale != nest.ScaleF && body.Scale != nest.ScaleC {
+			return nil, apiError{http.StatusBadRequest, fmt.Sprintf("Invalid scale '%s'", body.Scale)}
+		}
+		if body.Type != "" && body.Type != nest.TypeHigh && body.Type != nest.TypeLow {
+			return nil, apiError{http.StatusBadRequest, fmt.Sprintf("Invalid type '%s'", body.Type)}
+		}
+
+		temp := nest.NewTemp(body.Temperature, body.Scale)
+		field := nest.TargetTempField(body.Scale, body.Type)
+		change := fieldChange{
+			Target: thermostat.DeviceId,
+			Name:   thermostat.Name,
+			Field:  field,
+			Path:   nest.ThermostatPath(thermostat.DeviceId, field),
+			Value:  temp,
+		}
+
+		queued, err := makeChange(change, func(backend nest.ThermostatBackend) error {
+			set, err := backend.SetTargetTemp(thermostat.DeviceId, temp, body.Type)
+			if err == nil {
+				temp = set
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		scheduleRefresh()
+		return apiTarget{Temperature: temp.Value(), Scale: temp.Scale(), Queued: queued}, nil
+
+	case "mode":
+		var body struct {
+			Mode nest.HvacMode `json:"mode"`
+		}
+		if err := decodeApiBody(r, &body); err != nil {
+			return nil, err
+		}
+		switch body.Mode {
+		case nest.ModeHeat, nest.ModeCool, nest.ModeRange, nest.ModeOff:
+		default:
+			return nil, apiError{http.StatusBadRequest, fmt.Sprintf("Invalid mode '%s'", body.Mode)}
+		}
+
+		change := fieldChange{
+			Target: thermostat.DeviceId,
+			Name:   thermostat.Name,
+			Field:  "hvac_mode",
+			Path:   nest.ThermostatPath(thermostat.DeviceId, "hvac_mode"),
+			Value:  body.Mode,
+		}
+
+		queued, err := makeChange(change, func(backend nest.ThermostatBackend) error {
+			return backend.SetHvacMode(thermostat.DeviceId, body.Mode)
+		})
+		if err != nil {
+			return nil, err
+		}
+		scheduleRefresh()
+		return apiMode{Mode: body.Mode, Queued: queued}, nil
+	}
+
+	return nil, errNotFound
+}
+
+// GET /structures
+func apiStructures(r *http.Request, path []string) (interface{}, error) {
+	if r.Method != "GET" {
+		return nil, errMethod
+	}
+	if err := refreshApiCache(); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for id := range cache.AllData.Structures {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	structures := []nest.Structure{}
+	for _, id := range ids {
+		structures = append(structures, cache.AllData.Structures[id])
+	}
+	return structures, nil
+}
+
+// GET /structures/{id}
+// PUT /structures/{id}/presence
+func apiStructure(r *http.Request, path []string) (interface{}, error) {
+	if len(path) < 2 || len(path) > 3 {
+		return nil, errNotFound
+	}
+	if err := refreshApiCache(); err != nil {
+		return nil, err
+	}
+
+	structure, ok := cache.AllData.Structures[path[1]]
+	if !ok {
+		return nil, errNotFound
+	}
+
+	if len(path) == 2 {
+		if r.Method != "GET" {
+			return nil, errMethod
+		}
+		return structure, nil
+	}
+
+	if path[2] != "presence" {
+		return nil, errNotFound
+	}
+	if r.Method != "PUT" {
+		return nil, errMethod
+	}
+
+	var body struct {
+		Presence nest.Presence `json:"presence"`
+	}
+	if err := decodeApiBody(r, &body); err != nil {
+		return nil, err
+	}
+	if body.Presence != nest.Home && body.Presence != nest.Away {
+		return nil, apiError{http.StatusBadRequest, fmt.Sprintf("Invalid presence '%s'", body.Presence)}
+	}
+
+	change := fieldChange{
+		Target: structure.StructureId,
+		Name:   structure.Name,
+		Field:  "away",
+		Path:   nest.StructurePath(structure.StructureId, "away"),
+		Value:  body.Presence,
+	}
+
+	queued, err := makeChange(change, func(backend nest.ThermostatBackend) error {
+		return backend.SetPresence(structure.StructureId, body.Presence)
+	})
+	if err != nil {
+		return nil, err
+	}
+	scheduleRefresh()
+	return apiPresence{Presence: body.Presence, Queued: queued}, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+// Origins recorded in the audit log
+const (
+	OriginAlfred = "alfred"
+	OriginCli    = "cli"
+	OriginApi    = "api"
+	OriginQueue  = "queue"
+	OriginUndo   = "undo"
+)
+
+const MaxAuditItems = 100
+
+// AuditEntry is a line in the audit log. Result is "ok" or an error message.
+type AuditEntry struct {
+	Time   time.Time       `json:"time"`
+	Origin string          `json:"origin"`
+	Method string          `json:"method"`
+	Target string          `json:"target"`
+	Name   string          `json:"name"`
+	Field  string          `json:"field"`
+	Old    json.RawMessage `json:"old,omitempty"`
+	New    json.RawMessage `json:"new"`
+	Result string          `json:"result"`
+}
+
+// detectOrigin guesses whether the workflow was started by Alfred or from the
+// command line. Alfred sets alfred_* environment variables for the scripts it
+// runs.
+func detectOrigin() string {
+	if os.Getenv("alfred_version") != "" {
+		return OriginAlfred
+	}
+	return OriginCli
+}
+
+// parseApiPath splits a thermostat or structure field path into the
+// collection ("thermostats" or "structures"), the object ID and the field.
+func parseApiPath(path string) (collection, id, field string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) == 4 && parts[0] == "devices" {
+		parts = parts[1:]
+	}
+	if len(parts) != 3 {
+		return
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// auditWrite appends a write to the audit log, taking the old value from the
+// cache.
+func auditWrite(origin, path string, data []byte, simulated bool, err error) {
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Origin: origin,
+		Method: "PUT",
+		New:    json.RawMessage(data),
+		Result: "ok",
+	}
+	if err != nil {
+		entry.Result = err.Error()
+	} else if simulated {
+		entry.Result = "simulated"
+	}
+
+	var collection string
+	collection, entry.Target, entry.Field = parseApiPath(path)
+
+	switch collection {
+	case "thermostats":
+		if t, ok := cache.AllData.Devices.Thermostats[entry.Target]; ok {
+			entry.Name = t.Name
+			entry.Old, _ = cachedField(t, entry.Field)
+		}
+	case "structures":
+		if s, ok := cache.AllData.Structures[entry.Target]; ok {
+			entry.Name = s.Name
+			entry.Old, _ = cachedField(s, entry.Field)
+		}
+	default:
+		entry.Field = path
+	}
+
+	if err := appendAudit(entry); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
+
+func appendAudit(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(auditFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := os.OpenFile(auditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// loadAudit returns the entries in the audit log, oldest first. Lines that
+// can't be decoded are skipped.
+func loadAudit() (entries []AuditEntry, err error) {
+	file, err := os.Open(auditFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Println("Skipping bad audit log line:", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// log ---------------------------------------------------
+
+type LogCommand struct{}
+
+func (c LogCommand) Keyword() string {
+	return "log"
+}
+
+func (c LogCommand) IsEnabled() bool {
+	return true
+}
+
+func (c LogCommand) MenuItem() alfred.Item {
+	return alfred.NewKeywordItem(c.Keyword(), "", " ", "Browse changes made through this workflow")
+}
+
+// Items lists audit log entries, newest first. Each word in the query must
+// fuzzy match the entry's device name, field, origin or result.
+func (c LogCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	entries, err := loadAudit()
+	if err != nil {
+		return
+	}
+
+	words := strings.Fields(query)
+
+	for i := len(entries) - 1; i >= 0 && len(items) < MaxAuditItems; i-- {
+		e := entries[i]
+
+		matches := true
+		for _, word := range words {
+			if !alfred.FuzzyMatches(e.Name, word) && !alfred.FuzzyMatches(e.Field, word) &&
+				!alfred.FuzzyMatches(e.Origin, word) && !alfred.FuzzyMatches(e.Result, word) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		old := string(e.Old)
+		if old == "" {
+			old = "?"
+		}
+
+		name := e.Name
+		if name == "" {
+			name = e.Target
+		}
+
+		items = append(items, alfred.Item{
+			Title:       fmt.Sprintf("%s %s: %s → %s", name, e.Field, old, e.New),
+			SubtitleAll: tr("%s via %s, %s", formatTime(e.Time, time.Local), e.Origin, e.Result),
+			Valid:       alfred.Invalid,
+		})
+	}
+
+	if len(items) == 0 {
+		items = append(items, alfred.Item{
+			Title: tr("No matching changes"),
+			Valid: alfred.Invalid,
+		})
+	}
+
+	return
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"bufio"
+	"errors"
+	"fmt"
 	"net/url"
 	"os"
 	"os/exec"
+	"runtime"
+	"strings"
 
 	"github.com/jason0x43/go-alfred"
 )
@@ -19,7 +22,7 @@ func (c AuthorizeCommand) Keyword() string {
 }
 
 func (c AuthorizeCommand) IsEnabled() bool {
-	return config.AccessToken == ""
+	return !hasAuthorization(&config) && !needsSetup()
 }
 
 func (c AuthorizeCommand) MenuItem() alfred.Item {
@@ -31,29 +34,117 @@ func (c AuthorizeCommand) MenuItem() alfred.Item {
 	}
 }
 
+// Items offers to start authorization, or if a code or redirect URL has been
+// pasted into the query, to finish it with that.
 func (c AuthorizeCommand) Items(prefix, query string) ([]alfred.Item, error) {
-	item := c.MenuItem()
-	item.Arg = "authorize"
-	return []alfred.Item{item}, nil
+	code := strings.TrimSpace(query)
+	if code == "" {
+		item := c.MenuItem()
+		item.Arg = "authorize"
+		return []alfred.Item{item}, nil
+	}
+
+	return []alfred.Item{alfred.Item{
+		Title:       "Finish authorizing with this code",
+		SubtitleAll: "Paste the code, or the URL the browser was redirected to",
+		Arg:         "authorize code " + code,
+	}}, nil
 }
 
+// Do starts authorization, or finishes it with a code. The pending request's
+// state and PKCE verifier are saved so the code can be redeemed by a later
+// invocation.
+//
+//	authorize            open the authorization page in a browser, if there is
+//	                     one, and wait for the callback; otherwise, as paste
+//	authorize paste      print the authorization URL and read the code from
+//	                     stdin
+//	authorize code CODE  redeem a code, or the URL the browser was redirected to
 func (c AuthorizeCommand) Do(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	if strings.HasPrefix(query, "code ") {
+		return finishAuthorization(strings.TrimPrefix(query, "code "))
+	}
+
+	auth, err := newPendingAuth()
+	if err != nil {
+		return "", err
+	}
+	if err := writeJsonAtomic(authFile, &auth); err != nil {
+		return "", err
+	}
+
+	oauthUrl, err := authorizationUrl(auth)
+	if err != nil {
+		return "", err
+	}
+
+	browser := browserCommand()
+	if query == "paste" || browser == "" {
+		return pasteCode(oauthUrl)
+	}
+
+	// the serve process reads the pending request from authFile
 	if err := exec.Command(os.Args[0], "do", "serve").Start(); err != nil {
 		return "", err
 	}
+	return "", exec.Command(browser, oauthUrl).Run()
+}
 
-	randBytes := make([]byte, 32)
-	if _, err := rand.Read(randBytes); err != nil {
+// browserCommand returns the command that opens a URL in a browser: open on
+// macOS, or xdg-open where there's a display to open it on. It returns an
+// empty string if there's no browser, e.g. over SSH.
+func browserCommand() string {
+	if _, err := exec.LookPath("open"); err == nil && runtime.GOOS == "darwin" {
+		return "open"
+	}
+	if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+		return ""
+	}
+	if _, err := exec.LookPath("xdg-open"); err == nil {
+		return "xdg-open"
+	}
+	return ""
+}
+
+// pasteCode prints the authorization URL and reads the code from stdin. If
+// there's nothing on stdin, the code can be given later with authorize code.
+func pasteCode(oauthUrl string) (string, error) {
+	fmt.Println("Open this URL in a browser and allow access:")
+	fmt.Println()
+	fmt.Println("  " + oauthUrl)
+	fmt.Println()
+	fmt.Print("Then paste the code, or the URL you were redirected to: ")
+
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(line) == "" {
+		return "No code entered; finish with: authorize code CODE", nil
+	}
+	return finishAuthorization(line)
+}
+
+// finishAuthorization redeems a pasted code, or the code in a pasted redirect
+// URL, for the pending authorization request.
+func finishAuthorization(input string) (string, error) {
+	auth, err := loadPendingAuth()
+	if err != nil {
 		return "", err
 	}
-	randString := base64.URLEncoding.EncodeToString(randBytes)
 
-	params := url.Values{}
-	params.Add("client_id", ClientId)
-	params.Add("state", randString)
+	code := strings.TrimSpace(input)
+	if u, err := url.Parse(code); err == nil && u.Query().Get("code") != "" {
+		if u.Query().Get("state") != auth.State {
+			return "", errors.New("The redirect URL doesn’t match the authorization request")
+		}
+		code = u.Query().Get("code")
+	}
+
+	if err := redeemCode(code, auth.Verifier); err != nil {
+		return "", err
+	}
+	os.Remove(authFile)
 
-	oauthUrl := "https://home.nest.com/login/oauth2?" + params.Encode()
-	return "", exec.Command("open", oauthUrl).Run()
+	return "Authorization was successful", nil
 }
 
 // auth server -------------------------------------------
@@ -69,6 +160,5 @@ func (c AuthServerCommand) IsEnabled() bool {
 }
 
 func (c AuthServerCommand) Do(query string) (string, error) {
-	err := StartAuthServer()
-	return "", err
+	return "", StartAuthServer()
 }
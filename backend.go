@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/jason0x43/alfred-nest/generic"
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/alfred-nest/sdm"
+)
+
+// openBackend returns the thermostat backend for the active profile: the Nest
+// API, or the backend at BackendUrl if one is configured. Writes are recorded
+// with writeOrigin as their origin.
+func openBackend() (nest.ThermostatBackend, error) {
+	return openBackendFor(writeOrigin)
+}
+
+// openBackendFor returns the active profile's backend, wrapped so its writes
+// are audited with the given origin and simulated in dry-run mode.
+func openBackendFor(origin string) (nest.ThermostatBackend, error) {
+	token := config.AccessToken
+	if usesAccessToken(config.BackendUrl) {
+		token = freshAccessToken()
+	}
+	backend, err := newBackend(config.BackendUrl, token)
+	if err != nil {
+		return nil, err
+	}
+	return &trackedBackend{backend: backend, origin: origin, dryRun: isDryRun()}, nil
+}
+
+// newBackend returns the backend for a URL. An empty URL is the Nest API,
+// sdm://PROJECT is the Smart Device Management API for a Device Access
+// project, and http(s) and mqtt(s) URLs are generic backends. An SDM URL may
+// have a host parameter pointing at a stand-in server. Each backend counts its
+// requests in the API metrics.
+func newBackend(rawurl, token string) (nest.ThermostatBackend, error) {
+	if rawurl == "" {
+		session := nest.OpenSession(token)
+		session.OnRequest = countRequest
+		return session, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "sdm" {
+		if u.Host == "" {
+			return nil, errors.New("SDM backend URLs need a project ID, e.g. sdm://PROJECT")
+		}
+		session := sdm.OpenSession(u.Host, token)
+		session.OnRequest = countRequest
+		if host := u.Query().Get("host"); host != "" {
+			session.Host = strings.TrimSuffix(host, "/")
+		}
+		return session, nil
+	}
+
+	backend, err := generic.Open(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	backend.OnRequest = countRequest
+	return backend, nil
+}
+
+// usesAccessToken returns true if the backend at a URL authenticates with the
+// token saved by the authorize command. SDM URLs with a host parameter point
+// at a stand-in server, which doesn't need one.
+func usesAccessToken(rawurl string) bool {
+	if rawurl == "" {
+		return true
+	}
+	u, err := url.Parse(rawurl)
+	return err == nil && u.Scheme == "sdm" && u.Query().Get("host") == ""
+}
+
+// writeField sets a thermostat or structure field to a JSON value, for
+// replaying queued writes and undoing changes. The fields the commands change
+// are supported.
+func writeField(origin, target, field, path string, value json.RawMessage) error {
+	backend, err := openBackendFor(origin)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case field == "hvac_mode":
+		var mode nest.HvacMode
+		if err := json.Unmarshal(value, &mode); err != nil {
+			return err
+		}
+		return backend.SetHvacMode(target, mode)
+
+	case field == "away":
+		var presence nest.Presence
+		if err := json.Unmarshal(value, &presence); err != nil {
+			return err
+		}
+		return backend.SetPresence(target, presence)
+
+	case field == "fan_timer_active":
+		var on bool
+		if err := json.Unmarshal(value, &on); err != nil {
+			return err
+		}
+		return backend.SetFanTimer(target, on)
+
+	case strings.HasPrefix(field, "target_temperature_"):
+		var temp float64
+		if err := json.Unmarshal(value, &temp); err != nil {
+			return err
+		}
+
+		parts := strings.Split(strings.TrimPrefix(field, "target_temperature_"), "_")
+		scale := nest.TempScale(strings.ToUpper(parts[len(parts)-1]))
+		var hilo nest.HighLow
+		if len(parts) == 2 {
+			hilo = nest.HighLow(parts[0])
+		}
+
+		_, err := backend.SetTargetTemp(target, nest.NewTemp(temp, scale), hilo)
+		return err
+	}
+
+	return errors.New("Can’t change '" + field + "' with this backend")
+}
+
+// trackedBackend wraps a backend so that, whatever the backend, writes are
+// recorded in the audit log. In dry-run mode writes aren't sent to the backend; they're applied to the
+// cache instead.
+type trackedBackend struct {
+	backend nest.ThermostatBackend
+	origin  string
+	dryRun  bool
+}
+
+// fieldWrite is a value written to the API path of a field.
+type fieldWrite struct {
+	path  string
+	value interface{}
+}
+
+func (b *trackedBackend) GetAllData() (nest.AllData, error) {
+	return b.backend.GetAllData()
+}
+
+func (b *trackedBackend) GetThermostats() ([]nest.Thermostat, error) {
+	return b.backend.GetThermostats()
+}
+
+func (b *trackedBackend) SetTargetTemp(id string, temp nest.Temperature, hilo nest.HighLow) (nest.Temperature, error) {
+	result := temp
+	err := b.write(func() (err error) {
+		result, err = b.backend.SetTargetTemp(id, temp, hilo)
+		return
+	}, fieldWrite{nest.ThermostatPath(id, nest.TargetTempField(temp.Scale(), hilo)), temp.Value()})
+	return result, err
+}
+
+func (b *trackedBackend) SetTargetRange(id string, low, high nest.Temperature) error {
+	high = nest.ConvertTemp(high, low.Scale())
+	return b.write(func() error {
+		return b.backend.SetTargetRange(id, low, high)
+	},
+		fieldWrite{nest.ThermostatPath(id, nest.TargetTempField(low.Scale(), nest.TypeLow)), low.Value()},
+		fieldWrite{nest.ThermostatPath(id, nest.TargetTempField(high.Scale(), nest.TypeHigh)), high.Value()})
+}
+
+func (b *trackedBackend) SetHvacMode(id string, mode nest.HvacMode) error {
+	return b.write(func() error {
+		return b.backend.SetHvacMode(id, mode)
+	}, fieldWrite{nest.ThermostatPath(id, "hvac_mode"), mode})
+}
+
+func (b *trackedBackend) SetPresence(structureId string, presence nest.Presence) error {
+	return b.write(func() error {
+		return b.backend.SetPresence(structureId, presence)
+	}, fieldWrite{nest.StructurePath(structureId, "away"), presence})
+}
+
+func (b *trackedBackend) SetFanTimer(id string, on bool) error {
+	return b.write(func() error {
+		return b.backend.SetFanTimer(id, on)
+	}, fieldWrite{nest.ThermostatPath(id, "fan_timer_active"), on})
+}
+
+// write makes a change with set, or in dry-run mode applies the fields it
+// would change to the cache, and records each field in the audit log.
+func (b *trackedBackend) write(set func() error, writes ...fieldWrite) (err error) {
+	if !b.dryRun {
+		err = set()
+	}
+
+	for _, w := range writes {
+		data, _ := json.Marshal(w.value)
+		auditWrite(b.origin, w.path, data, b.dryRun, err)
+
+		if b.dryRun {
+			log.Printf("dry run: PUT %s %s", w.path, data)
+			if err := simulateWrite(w.path, data); err != nil {
+				log.Println("Error simulating write:", err)
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/go-alfred"
+)
+
+type ComfortClass string
+
+const (
+	ComfortDry      = ComfortClass("dry")
+	ComfortOk       = ComfortClass("comfortable")
+	ComfortHumid    = ComfortClass("humid")
+	ComfortMoldRisk = ComfortClass("mold risk")
+)
+
+// Humidity and dew point thresholds used to classify comfort
+const (
+	dryHumidity      = 30
+	humidHumidity    = 60
+	moldHumidity     = 70
+	humidDewPointC   = 16
+	moldDewPointC    = 20
+	feelsLikeDegrees = 2
+)
+
+// Comfort holds values derived from a thermostat's ambient temperature and
+// humidity.
+type Comfort struct {
+	DewPoint  nest.Temperature
+	HeatIndex nest.Temperature
+	Class     ComfortClass
+}
+
+// getComfort computes a thermostat's comfort metrics in a given scale.
+func getComfort(t *nest.Thermostat, scale nest.TempScale) Comfort {
+	tempC := float64(t.AmbientTemperatureC)
+	rh := float64(t.Humidity)
+
+	dewPointC := dewPoint(tempC, rh)
+	heatIndexC := fToC(heatIndex(cToF(tempC), rh))
+
+	var class ComfortClass
+	switch {
+	case rh >= moldHumidity || dewPointC >= moldDewPointC:
+		class = ComfortMoldRisk
+	case rh > humidHumidity || dewPointC >= humidDewPointC:
+		class = ComfortHumid
+	case rh < dryHumidity:
+		class = ComfortDry
+	default:
+		class = ComfortOk
+	}
+
+	return Comfort{
+		DewPoint:  tempInScale(dewPointC, scale),
+		HeatIndex: tempInScale(heatIndexC, scale),
+		Class:     class,
+	}
+}
+
+// dewPoint returns the dew point in Celsius using the Magnus formula.
+func dewPoint(tempC, humidity float64) float64 {
+	if humidity <= 0 {
+		return math.Inf(-1)
+	}
+	const b, c = 17.62, 243.12
+	gamma := math.Log(humidity/100) + b*tempC/(c+tempC)
+	return c * gamma / (b - gamma)
+}
+
+// heatIndex returns the NWS heat index in Fahrenheit. Below 80°F the simple
+// Steadman approximation is used; above it, the Rothfusz regression with the
+// NWS adjustments for low and high humidity.
+func heatIndex(tempF, humidity float64) float64 {
+	simple := 0.5 * (tempF + 61 + (tempF-68)*1.2 + humidity*0.094)
+	if (simple+tempF)/2 < 80 {
+		return simple
+	}
+
+	t, rh := tempF, humidity
+	hi := -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh - 0.00683783*t*t -
+		0.05481717*rh*rh + 0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+	if rh < 13 && t >= 80 && t <= 112 {
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	} else if rh > 85 && t >= 80 && t <= 87 {
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+	return hi
+}
+
+func cToF(c float64) float64 {
+	return c*9/5 + 32
+}
+
+func fToC(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+// tempInScale converts a Celsius value to a temperature in the given scale,
+// rounded to one decimal place.
+func tempInScale(tempC float64, scale nest.TempScale) nest.Temperature {
+	value := tempC
+	if scale == nest.ScaleF {
+		value = cToF(tempC)
+	}
+	return nest.NewTemp(math.Floor(value*10+0.5)/10, scale)
+}
+
+// comfortSummary describes a thermostat's comfort in a few words.
+func comfortSummary(t *nest.Thermostat, scale nest.TempScale) string {
+	comfort := getComfort(t, scale)
+	return tr("Comfort: %s, dew point %s", tr(string(comfort.Class)), formatTemp(comfort.DewPoint))
+}
+
+// getComfortItems returns items describing a thermostat's comfort metrics and
+// suggestions for improving it. Suggestions that can be acted on have an Arg
+// that makes the change. Comfort is unknown if the thermostat doesn't report
+// humidity.
+func getComfortItems(t *nest.Thermostat, scale nest.TempScale) (items []alfred.Item) {
+	ambient := t.AmbientTemperature(scale)
+	if t.Humidity <= 0 {
+		return []alfred.Item{alfred.Item{
+			Title:       tr("%s: %s", t.Name, tr("unknown")),
+			SubtitleAll: tr("Temp: %s, Humidity: %s", formatTemp(ambient), tr("unknown")),
+			Valid:       alfred.Invalid,
+		}}
+	}
+
+	comfort := getComfort(t, scale)
+
+	items = append(items, alfred.Item{
+		Title: tr("%s: %s", t.Name, tr(string(comfort.Class))),
+		SubtitleAll: tr("Temp: %s, Humidity: %s, Dew point: %s, Heat index: %s",
+			formatTemp(ambient), formatHumidity(t.Humidity), formatTemp(comfort.DewPoint),
+			formatTemp(comfort.HeatIndex)),
+		Valid: alfred.Invalid,
+	})
+
+	suggest := func(title, subtitle string, msg *tempMessage) {
+		item := alfred.Item{
+			Title:       title,
+			SubtitleAll: subtitle,
+			Valid:       alfred.Invalid,
+		}
+		if msg != nil {
+			data, _ := json.Marshal(msg)
+			item.Arg = "temp " + string(data)
+			item.Valid = ""
+		}
+		items = append(items, item)
+	}
+
+	// lowering the cooling target makes the AC run longer, which removes more
+	// moisture
+	var lowerCooling *tempMessage
+	switch t.HvacMode {
+	case nest.ModeCool:
+		lowerCooling = &tempMessage{DeviceId: t.DeviceId, Scale: scale,
+			TargetTemp: t.TargetTemperature(scale).Value() - 1}
+	case nest.ModeRange:
+		lowerCooling = &tempMessage{DeviceId: t.DeviceId, Scale: scale, HiLo: nest.TypeHigh,
+			TargetTemp: t.TargetTemperatureHigh(scale).Value() - 1}
+	}
+
+	switch comfort.Class {
+	case ComfortMoldRisk, ComfortHumid:
+		subtitle := tr("Humidity above %d%% makes rooms feel clammy", humidHumidity)
+		if comfort.Class == ComfortMoldRisk {
+			subtitle = tr("Sustained humidity above %d%% or a high dew point risks mold", moldHumidity)
+		}
+		if lowerCooling != nil {
+			suggest(tr("Lower target 1° to reduce humidity load"), subtitle, lowerCooling)
+		} else {
+			suggest(tr("Run a dehumidifier or ventilate"), subtitle, nil)
+		}
+	case ComfortDry:
+		subtitle := tr("Humidity below %d%% can irritate skin and airways", dryHumidity)
+		if t.HvacMode == nest.ModeHeat || t.HvacMode == nest.ModeRange {
+			suggest(tr("Run a humidifier"), subtitle+"; "+tr("heating dries the air further"), nil)
+		} else {
+			suggest(tr("Run a humidifier"), subtitle, nil)
+		}
+	default:
+		suggest(tr("No changes needed"), tr("Humidity is between %d%% and %d%%", dryHumidity,
+			humidHumidity), nil)
+	}
+
+	if comfort.HeatIndex.Value()-ambient.Value() >= feelsLikeDegrees {
+		suggest(tr("Feels like %s", formatTemp(comfort.HeatIndex)),
+			tr("Humidity makes it feel warmer than it is"), nil)
+	}
+
+	return
+}
+
+// comfort -----------------------------------------------
+
+type ComfortCommand struct{}
+
+func (c ComfortCommand) Keyword() string {
+	return "comfort"
+}
+
+func (c ComfortCommand) IsEnabled() bool {
+	return isAuthorized() && config.NestId != ""
+}
+
+func (c ComfortCommand) MenuItem() alfred.Item {
+	return alfred.NewKeywordItem(c.Keyword(), "", " ", "Dew point, heat index and humidity suggestions")
+}
+
+// Items shows comfort metrics for the default Nest, or for the thermostats
+// matching the query.
+func (c ComfortCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	if err = checkRefresh(); err != nil {
+		return
+	}
+
+	var thermostats []nest.Thermostat
+	if query == "" {
+		if t, ok := cache.AllData.Devices.Thermostats[config.NestId]; ok {
+			thermostats = append(thermostats, t)
+		}
+	} else {
+		thermostats = findThermostats(query, true)
+	}
+
+	for _, t := range thermostats {
+		items = append(items, getComfortItems(&t, config.Scale)...)
+	}
+
+	if len(items) == 0 {
+		items = append(items, alfred.Item{
+			Title: "No matching thermostats",
+			Valid: alfred.Invalid,
+		})
+	}
+
+	return
+}
@@ -2,9 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/jason0x43/alfred-nest/nest"
 	"github.com/jason0x43/go-alfred"
 )
 
@@ -29,11 +35,20 @@ func (t ConfigCommand) Items(prefix, query string) (items []alfred.Item, err err
 	if len(parts) == 1 {
 		addItem := func(name, desc string) {
 			if alfred.FuzzyMatches(name, query) {
-				items = append(items, alfred.NewKeywordItem(name, prefix, " ", desc))
+				items = append(items, alfred.NewKeywordItem(name, prefix, " ", tr(desc)))
 			}
 		}
 		addItem("nest", "Select your default Nest")
 		addItem("scale", "Select temperature scale used in this workflow")
+		addItem("ttl", "Set how many minutes cached data is considered fresh")
+		addItem("emergency", "Set how many minutes of emergency heat trigger an alert")
+		addItem("alert", "Set a shell command to run for each alert")
+		addItem("dryrun", "Simulate changes instead of sending them to Nest")
+		addItem("alias", "Add or remove alternate names for your Nests")
+		addItem("language", "Select the language used in this workflow")
+		addItem("weather", "Set a weather station file or URL for outdoor conditions")
+		addItem("backend", "Use thermostats from the SDM API or an HTTP or MQTT backend")
+		addItem("webhook", "Add or remove URLs notified when a thermostat changes")
 	} else {
 		property := parts[0]
 		query = parts[1]
@@ -60,6 +75,72 @@ func (t ConfigCommand) Items(prefix, query string) (items []alfred.Item, err err
 		case "scale":
 			prefix += property + " "
 			items = append(items, getScaleItems(prefix, query, config.Scale)...)
+
+		case "alias":
+			prefix += property + " "
+			items = append(items, getAliasItems(prefix, query)...)
+
+		case "language":
+			prefix += property + " "
+			addLanguage := func(lang, name string) {
+				data := configMessage{Property: "language", Name: lang}
+				dataString, _ := json.Marshal(data)
+
+				if alfred.FuzzyMatches(lang, query) || alfred.FuzzyMatches(name, query) {
+					items = append(items, alfred.MakeChoice(alfred.Item{
+						Title:        name,
+						Autocomplete: prefix + lang,
+						Arg:          "config " + string(dataString),
+					}, config.Language == lang))
+				}
+			}
+			addLanguage("", tr("Automatic (use the Nest’s locale)"))
+			var langs []string
+			for lang := range languageNames {
+				langs = append(langs, lang)
+			}
+			sort.Strings(langs)
+			for _, lang := range langs {
+				addLanguage(lang, languageNames[lang])
+			}
+
+		case "dryrun":
+			prefix += property + " "
+			addChoice := func(name, desc string, enabled bool) {
+				data := configMessage{Property: "dryrun", DryRun: enabled}
+				dataString, _ := json.Marshal(data)
+
+				if alfred.FuzzyMatches(name, query) {
+					items = append(items, alfred.MakeChoice(alfred.Item{
+						Title:        name,
+						SubtitleAll:  tr(desc),
+						Autocomplete: prefix + name,
+						Arg:          "config " + string(dataString),
+					}, config.DryRun == enabled))
+				}
+			}
+			addChoice("on", "Simulate changes", true)
+			addChoice("off", "Send changes to Nest", false)
+
+		case "alert":
+			items = append(items, getAlertItems(query)...)
+
+		case "weather":
+			items = append(items, getWeatherItems(query)...)
+
+		case "backend":
+			items = append(items, getBackendItems(query)...)
+
+		case "webhook":
+			prefix += property + " "
+			items = append(items, getWebhookItems(prefix, query)...)
+
+		case "ttl":
+			items = append(items, getMinutesItems("ttl", "cache TTL", int(cacheTtl().Minutes()), query)...)
+
+		case "emergency":
+			items = append(items, getMinutesItems("emergency", "emergency heat alert time",
+				int(emergencyHeatLimit().Minutes()), query)...)
 		}
 	}
 
@@ -74,31 +155,363 @@ func (c ConfigCommand) Do(query string) (out string, err error) {
 		return
 	}
 
-	switch msg.Property {
-	case "nest":
-		config.NestId = msg.DeviceId
-		out = "Set default Nest to '" + msg.Name + "'"
-	case "scale":
-		config.Scale = msg.Scale
-		if config.Scale == ScaleC {
-			out = "Using Celsius scale"
-		} else {
-			out = "Using Fahrenheit scale"
+	err = updateConfig(func(c *Config) error {
+		switch msg.Property {
+		case "nest":
+			c.NestId = msg.DeviceId
+			out = tr("Set default Nest to '%s'", msg.Name)
+		case "scale":
+			c.Scale = msg.Scale
+			if c.Scale == nest.ScaleC {
+				out = tr("Using Celsius scale")
+			} else {
+				out = tr("Using Fahrenheit scale")
+			}
+		case "alias":
+			if c.Aliases == nil {
+				c.Aliases = map[string]string{}
+			}
+			if msg.DeviceId == "" {
+				delete(c.Aliases, msg.Name)
+				out = tr("Removed alias '%s'", msg.Name)
+			} else {
+				c.Aliases[msg.Name] = msg.DeviceId
+				out = tr("Added alias '%s'", msg.Name)
+			}
+		case "language":
+			c.Language = msg.Name
+			if c.Language == "" {
+				out = tr("Using the Nest’s language")
+			} else {
+				out = tr("Using %s", languageNames[c.Language])
+			}
+		case "dryrun":
+			c.DryRun = msg.DryRun
+			if c.DryRun {
+				out = tr("Dry-run mode enabled")
+			} else {
+				out = tr("Dry-run mode disabled")
+			}
+		case "alert":
+			c.AlertCommand = msg.Name
+			if c.AlertCommand == "" {
+				out = tr("Removed alert command")
+			} else {
+				out = tr("Running '%s' for each alert", msg.Name)
+			}
+		case "weather":
+			c.WeatherSource = msg.Name
+			if c.WeatherSource == "" {
+				out = tr("Removed weather source")
+			} else {
+				out = tr("Reading outdoor conditions from %s", msg.Name)
+			}
+		case "backend":
+			c.BackendUrl = msg.Name
+			c.NestId = ""
+			if c.BackendUrl == "" {
+				out = tr("Using Nest")
+			} else {
+				out = tr("Using thermostats from %s", msg.Name)
+			}
+		case "webhook":
+			var hooks []Webhook
+			for _, hook := range c.Webhooks {
+				if hook.Url != msg.Name {
+					hooks = append(hooks, hook)
+				}
+			}
+			if msg.Remove {
+				out = tr("Removed webhook %s", msg.Name)
+			} else {
+				hooks = append(hooks, Webhook{Url: msg.Name, Secret: msg.Secret})
+				out = tr("Added webhook %s", msg.Name)
+			}
+			c.Webhooks = hooks
+		case "ttl":
+			c.CacheTtl = msg.Minutes
+			out = tr("Cache TTL set to %d minutes", msg.Minutes)
+		case "emergency":
+			c.EmergencyHeatMinutes = msg.Minutes
+			out = tr("Emergency heat alert time set to %d minutes", msg.Minutes)
+		default:
+			return errors.New("Unknown property '" + msg.Property + "'")
 		}
+		return nil
+	})
+
+	if err == nil && (msg.Property == "dryrun" && !msg.DryRun || msg.Property == "weather" || msg.Property == "backend") {
+		// drop simulated changes from the cache
+		scheduleRefresh()
 	}
 
-	if out != "" {
-		if err := alfred.SaveJson(configFile, &config); err != nil {
-			log.Printf("Error saving cache: %s\n", err)
+	return
+}
+
+type configMessage struct {
+	Property string         `json:",omitempty"`
+	Name     string         `json:",omitempty"`
+	DeviceId string         `json:",omitempty"`
+	Scale    nest.TempScale `json:",omitempty"`
+	Minutes  int            `json:",omitempty"`
+	DryRun   bool           `json:",omitempty"`
+	Secret   string         `json:",omitempty"`
+	Remove   bool           `json:",omitempty"`
+}
+
+// getAliasItems lists the existing aliases, which can be selected to remove
+// them, or if query is a new alias, the thermostats it can be assigned to.
+func getAliasItems(prefix, query string) (items []alfred.Item) {
+	alias := strings.TrimSpace(query)
+
+	if _, exists := config.Aliases[alias]; alias == "" || exists {
+		var aliases []string
+		for a := range config.Aliases {
+			aliases = append(aliases, a)
+		}
+		sort.Strings(aliases)
+
+		for _, a := range aliases {
+			if !alfred.FuzzyMatches(a, alias) {
+				continue
+			}
+			data := configMessage{Property: "alias", Name: a}
+			dataString, _ := json.Marshal(data)
+			thermostat := cache.AllData.Devices.Thermostats[config.Aliases[a]]
+			items = append(items, alfred.Item{
+				Title:        fmt.Sprintf("%s → %s", a, thermostat.Name),
+				SubtitleAll:  tr("Press Enter to remove this alias"),
+				Autocomplete: prefix + a,
+				Arg:          "config " + string(dataString),
+			})
+		}
+
+		if len(items) == 0 {
+			items = append(items, alfred.Item{
+				Title:       tr("Type a new alias"),
+				SubtitleAll: tr("Then choose the Nest it refers to"),
+				Valid:       alfred.Invalid,
+			})
 		}
+		return
 	}
 
+	for _, t := range findThermostats("", true) {
+		data := configMessage{Property: "alias", Name: alias, DeviceId: t.DeviceId}
+		dataString, _ := json.Marshal(data)
+		items = append(items, alfred.Item{
+			Title:       tr("Use '%s' for %s", alias, t.Name),
+			SubtitleAll: "ID: " + t.DeviceId,
+			Arg:         "config " + string(dataString),
+		})
+	}
 	return
 }
 
-type configMessage struct {
-	Property string    `json:",omitempty"`
-	Name     string    `json:",omitempty"`
-	DeviceId string    `json:",omitempty"`
-	Scale    TempScale `json:",omitempty"`
+// getMinutesItems returns items for setting a property that's a number of
+// minutes.
+func getMinutesItems(property, name string, current int, query string) (items []alfred.Item) {
+	name = tr(name)
+	if query == "" {
+		return []alfred.Item{alfred.Item{
+			Title:       tr("%s is %d minutes", strings.ToUpper(name[:1])+name[1:], current),
+			SubtitleAll: tr("Enter a number of minutes"),
+			Valid:       alfred.Invalid,
+		}}
+	}
+
+	minutes, err := strconv.Atoi(query)
+	if err != nil || minutes <= 0 {
+		return []alfred.Item{alfred.Item{
+			Title:       tr("Invalid number of minutes '%s'", query),
+			SubtitleAll: tr("Enter a number of minutes"),
+			Valid:       alfred.Invalid,
+		}}
+	}
+
+	data := configMessage{Property: property, Minutes: minutes}
+	dataString, _ := json.Marshal(data)
+	return []alfred.Item{alfred.Item{
+		Title:       tr("Set %s to %d minutes", name, minutes),
+		SubtitleAll: tr("Currently %d minutes", current),
+		Arg:         "config " + string(dataString),
+	}}
+}
+
+// getAlertItems returns an item for running the shell command in query for
+// each alert, or for removing the current one.
+func getAlertItems(query string) (items []alfred.Item) {
+	command := strings.TrimSpace(query)
+
+	if command == "" {
+		if config.AlertCommand == "" {
+			return []alfred.Item{alfred.Item{
+				Title:       tr("No alert command"),
+				SubtitleAll: tr("Enter a shell command; the alert is in $%s", AlertEnv),
+				Valid:       alfred.Invalid,
+			}}
+		}
+
+		data := configMessage{Property: "alert"}
+		dataString, _ := json.Marshal(data)
+		return []alfred.Item{alfred.Item{
+			Title:       tr("Remove alert command"),
+			SubtitleAll: tr("Currently %s", config.AlertCommand),
+			Arg:         "config " + string(dataString),
+		}}
+	}
+
+	data := configMessage{Property: "alert", Name: command}
+	dataString, _ := json.Marshal(data)
+	return []alfred.Item{alfred.Item{
+		Title:       tr("Run '%s' for each alert", command),
+		SubtitleAll: tr("The alert is in $%s", AlertEnv),
+		Arg:         "config " + string(dataString),
+	}}
+}
+
+// getWeatherItems returns items for setting the weather source to the file
+// path or URL in query, or for removing the current one.
+func getWeatherItems(query string) (items []alfred.Item) {
+	source := strings.TrimSpace(query)
+
+	if source == "" {
+		if config.WeatherSource == "" {
+			return []alfred.Item{alfred.Item{
+				Title:       tr("No weather source"),
+				SubtitleAll: tr("Enter the path or URL of a weather station’s JSON output"),
+				Valid:       alfred.Invalid,
+			}}
+		}
+
+		data := configMessage{Property: "weather"}
+		dataString, _ := json.Marshal(data)
+		return []alfred.Item{alfred.Item{
+			Title:       tr("Remove weather source"),
+			SubtitleAll: tr("Currently %s", config.WeatherSource),
+			Arg:         "config " + string(dataString),
+		}}
+	}
+
+	// only files are checked as the source is typed, since a partial URL may
+	// not respond until the request times out
+	subtitle := tr("The URL will be read on the next refresh")
+	if provider, ok := weatherProvider(source).(fileWeather); ok {
+		if weather, err := provider.Weather(); err != nil {
+			subtitle = tr("Couldn’t read a weather station reading: %s", err)
+		} else {
+			subtitle = outdoorSummary(&weather, config.Scale)
+		}
+	}
+
+	data := configMessage{Property: "weather", Name: source}
+	dataString, _ := json.Marshal(data)
+	return []alfred.Item{alfred.Item{
+		Title:       tr("Read outdoor conditions from %s", source),
+		SubtitleAll: subtitle,
+		Arg:         "config " + string(dataString),
+	}}
+}
+
+// getBackendItems returns an item for using the backend at the URL in query,
+// or for switching back to Nest.
+func getBackendItems(query string) (items []alfred.Item) {
+	rawurl := strings.TrimSpace(query)
+
+	if rawurl == "" {
+		if config.BackendUrl == "" {
+			return []alfred.Item{alfred.Item{
+				Title:       tr("Using Nest"),
+				SubtitleAll: tr("Enter an sdm://, http://, https://, mqtt:// or mqtts:// URL"),
+				Valid:       alfred.Invalid,
+			}}
+		}
+
+		data := configMessage{Property: "backend"}
+		dataString, _ := json.Marshal(data)
+		return []alfred.Item{alfred.Item{
+			Title:       tr("Use Nest"),
+			SubtitleAll: tr("Currently %s", config.BackendUrl),
+			Arg:         "config " + string(dataString),
+		}}
+	}
+
+	if _, err := newBackend(rawurl, ""); err != nil {
+		return []alfred.Item{alfred.Item{
+			Title:       tr("Invalid backend URL"),
+			SubtitleAll: err.Error(),
+			Valid:       alfred.Invalid,
+		}}
+	}
+
+	data := configMessage{Property: "backend", Name: rawurl}
+	dataString, _ := json.Marshal(data)
+	return []alfred.Item{alfred.Item{
+		Title:       tr("Use thermostats from %s", rawurl),
+		SubtitleAll: tr("The default Nest will be chosen on the next refresh"),
+		Arg:         "config " + string(dataString),
+	}}
+}
+
+// getWebhookItems lists the webhooks, which can be selected to remove them, or
+// if query is a new URL, optionally followed by a secret, an item to add it.
+func getWebhookItems(prefix, query string) (items []alfred.Item) {
+	parts := strings.Fields(query)
+
+	if len(parts) == 0 || !strings.Contains(parts[0], "://") {
+		for _, hook := range config.Webhooks {
+			if !alfred.FuzzyMatches(hook.Url, query) {
+				continue
+			}
+			subtitle := tr("Unsigned")
+			if hook.Secret != "" {
+				subtitle = tr("Signed")
+			}
+			data := configMessage{Property: "webhook", Name: hook.Url, Remove: true}
+			dataString, _ := json.Marshal(data)
+			items = append(items, alfred.Item{
+				Title:        hook.Url,
+				SubtitleAll:  tr("%s; press Enter to remove this webhook", subtitle),
+				Autocomplete: prefix + hook.Url,
+				Arg:          "config " + string(dataString),
+			})
+		}
+
+		if len(items) == 0 {
+			items = append(items, alfred.Item{
+				Title:       tr("Type a webhook URL"),
+				SubtitleAll: tr("Optionally followed by a secret to sign requests with"),
+				Valid:       alfred.Invalid,
+			})
+		}
+		return
+	}
+
+	u, err := url.Parse(parts[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(parts) > 2 {
+		return []alfred.Item{alfred.Item{
+			Title:       tr("Invalid webhook"),
+			SubtitleAll: tr("Enter an http:// or https:// URL, optionally followed by a secret"),
+			Valid:       alfred.Invalid,
+		}}
+	}
+
+	data := configMessage{Property: "webhook", Name: parts[0]}
+	subtitle := tr("Requests won’t be signed")
+	if len(parts) == 2 {
+		data.Secret = parts[1]
+		subtitle = tr("Requests will be signed with the secret")
+	}
+	for _, hook := range config.Webhooks {
+		if hook.Url == data.Name {
+			subtitle += tr("; replaces the existing webhook")
+		}
+	}
+
+	dataString, _ := json.Marshal(data)
+	return []alfred.Item{alfred.Item{
+		Title:       tr("Add webhook %s", data.Name),
+		SubtitleAll: subtitle,
+		Arg:         "config " + string(dataString),
+	}}
 }
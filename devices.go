@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/jason0x43/alfred-nest/nest"
 	"github.com/jason0x43/go-alfred"
 )
 
@@ -38,30 +38,45 @@ func (t DevicesCommand) Items(prefix, query string) (items []alfred.Item, err er
 	}
 
 	if len(parts) == 1 {
-		for _, t := range cache.AllData.Devices.Thermostats {
-			if alfred.FuzzyMatches(t.Name, query) {
-				items = append(items, alfred.Item{
-					Title:        t.Name,
-					Autocomplete: prefix + t.Name + alfred.Separator + " ",
-					SubtitleAll:  "ID: " + t.DeviceId,
-					Valid:        alfred.Invalid,
-				})
-			}
+		for _, t := range findThermostats(query, true) {
+			items = append(items, getThermostatChoiceItem(prefix, &t))
 		}
 	} else {
 		name := strings.TrimSpace(parts[0])
-		thermostat, ok := getThermostatByName(name)
-		if !ok {
+		matches := findThermostats(name, true)
+
+		switch len(matches) {
+		case 0:
 			return items, errors.New("Unknown thermostat '" + name + "'")
+		case 1:
+			prefix += name + alfred.Separator + " "
+			return getDeviceItems(prefix, parts[1], matches[0].DeviceId)
+		default:
+			// several thermostats match, so let the user pick one by ID
+			for _, t := range matches {
+				item := getThermostatChoiceItem(prefix, &t)
+				item.Autocomplete = prefix + t.DeviceId + alfred.Separator + " "
+				items = append(items, item)
+			}
 		}
-
-		prefix += name + alfred.Separator + " "
-		return getDeviceItems(prefix, parts[1], thermostat.DeviceId)
 	}
 
 	return
 }
 
+func getThermostatChoiceItem(prefix string, t *nest.Thermostat) alfred.Item {
+	subtitle := "ID: " + t.DeviceId
+	if aliases := thermostatAliases(t.DeviceId); len(aliases) > 0 {
+		subtitle += ", aliases: " + strings.Join(aliases, ", ")
+	}
+	return alfred.Item{
+		Title:        t.Name,
+		Autocomplete: prefix + thermostatKey(t) + alfred.Separator + " ",
+		SubtitleAll:  subtitle,
+		Valid:        alfred.Invalid,
+	}
+}
+
 func getDeviceItems(prefix, query, deviceId string) (items []alfred.Item, err error) {
 	thermostat, ok := cache.AllData.Devices.Thermostats[deviceId]
 	if !ok {
@@ -74,10 +89,17 @@ func getDeviceItems(prefix, query, deviceId string) (items []alfred.Item, err er
 		parts[i] = strings.TrimSpace(p)
 	}
 
+	formatValue := func(value interface{}) string {
+		if temp, ok := value.(nest.Temperature); ok {
+			return formatTemp(temp)
+		}
+		return fmt.Sprintf("%v", value)
+	}
+
 	addAdjustableItem := func(property string, value interface{}) {
 		items = append(items, alfred.Item{
 			Title:        property,
-			Subtitle:     fmt.Sprintf("%v", value),
+			Subtitle:     formatValue(value),
 			Autocomplete: prefix + property + " ",
 			Valid:        alfred.Invalid,
 		})
@@ -86,7 +108,7 @@ func getDeviceItems(prefix, query, deviceId string) (items []alfred.Item, err er
 	addSelectableItem := func(property string, value interface{}) {
 		items = append(items, alfred.Item{
 			Title:        property,
-			Subtitle:     fmt.Sprintf("%v", value),
+			Subtitle:     formatValue(value),
 			Autocomplete: prefix + property + " ",
 			Valid:        alfred.Invalid,
 		})
@@ -94,24 +116,47 @@ func getDeviceItems(prefix, query, deviceId string) (items []alfred.Item, err er
 
 	if len(parts) == 1 {
 		if query == "" {
-			// TODO: only show icon for top item; use leaf icon if leaf is active
+			structure := cache.AllData.Structures[thermostat.StructureId]
 			items = append(items, alfred.Item{
 				Title:       thermostat.Name,
-				SubtitleAll: fmt.Sprintf("ID: %v, SW: %v", thermostat.DeviceId, thermostat.SoftwareVersion),
+				SubtitleAll: withCacheNote(fmt.Sprintf("ID: %v, SW: %v", thermostat.DeviceId, thermostat.SoftwareVersion)),
 				Valid:       alfred.Invalid,
+				Icon:        thermostatIcon(&thermostat, &structure),
 			})
 
-			var online string
-			if thermostat.IsOnline {
-				online = "Online"
-			} else {
-				online = "Offline"
+			online := tr("Online")
+			var onlineIcon string
+			if !thermostat.IsOnline {
+				online = tr("Offline")
+				onlineIcon = IconOffline
 			}
 
+			lastConnection := formatTime(thermostat.LastConnection, structureLocation(thermostat.StructureId))
 			items = append(items, alfred.Item{
 				Title:       online,
-				SubtitleAll: fmt.Sprintf("Last connected at %v", thermostat.LastConnection.Local().Format(time.RFC822)),
+				SubtitleAll: tr("Last connected at %s", lastConnection),
 				Valid:       alfred.Invalid,
+				Icon:        onlineIcon,
+			})
+
+			if item, ok := getEmergencyHeatItem(&thermostat); ok {
+				items = append(items, item)
+			}
+		}
+
+		if alfred.FuzzyMatches("comfort", query) {
+			// comfort can't be computed without a humidity reading
+			subtitle := tr("unknown")
+			if thermostat.Humidity > 0 {
+				comfort := getComfort(&thermostat, config.Scale)
+				subtitle = tr("%s, dew point %s, heat index %s", tr(string(comfort.Class)),
+					formatTemp(comfort.DewPoint), formatTemp(comfort.HeatIndex))
+			}
+			items = append(items, alfred.Item{
+				Title:        "comfort",
+				Subtitle:     subtitle,
+				Autocomplete: prefix + "comfort ",
+				Valid:        alfred.Invalid,
 			})
 		}
 
@@ -134,7 +179,7 @@ func getDeviceItems(prefix, query, deviceId string) (items []alfred.Item, err er
 		addTempItem := func(name, newValue string, value interface{}) {
 			if newValue != "" {
 				if v, err := strconv.ParseFloat(parts[1], 64); err == nil {
-					newTemp := NewTemp(v, config.Scale)
+					newTemp := nest.NewTemp(v, config.Scale)
 					items = append(items, alfred.Item{
 						Title:       fmt.Sprintf("Set %s to %v", name, newTemp),
 						SubtitleAll: fmt.Sprintf("Currently %v", value),
@@ -157,7 +202,7 @@ func getDeviceItems(prefix, query, deviceId string) (items []alfred.Item, err er
 			items = append(items, getScaleItems(prefix, parts[1], thermostat.TemperatureScale)...)
 		case "mode":
 			prefix += property + " "
-			items = append(items, getModeItems(prefix, parts[1], thermostat.HvacMode)...)
+			items = append(items, getModeItems(prefix, parts[1], thermostat.DeviceId, thermostat.HvacMode)...)
 		case "away-low":
 			prefix += property + " "
 			addTempItem(property, parts[1], thermostat.AwayTemperatureLow(config.Scale))
@@ -175,24 +220,30 @@ type choiceMessage struct {
 	Value    interface{}
 }
 
-func getModeItems(prefix, query string, selected HvacMode) (items []alfred.Item) {
-	addItem := func(mode HvacMode, desc string) {
+func getModeItems(prefix, query, deviceId string, selected nest.HvacMode) (items []alfred.Item) {
+	addItem := func(mode nest.HvacMode, desc string) {
+		data := modeMessage{DeviceId: deviceId, Mode: mode}
+		dataString, _ := json.Marshal(data)
+
 		if alfred.FuzzyMatches(string(mode), query) {
 			items = append(items, alfred.MakeChoice(alfred.Item{
 				Title:        string(mode),
 				SubtitleAll:  desc,
 				Autocomplete: prefix + string(mode),
+				Arg:          "mode " + string(dataString),
+				Icon:         modeIcon(mode),
 			}, selected == mode))
 		}
 	}
-	addItem(ModeHeat, "Use the heater to maintain a minimum temperature")
-	addItem(ModeCool, "Use the AC to maintain a maximum temperature")
-	addItem(ModeRange, "Use both the heater and AC to maintain a temperature range")
+	addItem(nest.ModeHeat, tr("Use the heater to maintain a minimum temperature"))
+	addItem(nest.ModeCool, tr("Use the AC to maintain a maximum temperature"))
+	addItem(nest.ModeRange, tr("Use both the heater and AC to maintain a temperature range"))
+	addItem(nest.ModeOff, tr("Turn off heating and cooling"))
 	return alfred.SortItemsForKeyword(items, query)
 }
 
-func getScaleItems(prefix, query string, selected TempScale) (items []alfred.Item) {
-	addItem := func(scale TempScale, desc string) {
+func getScaleItems(prefix, query string, selected nest.TempScale) (items []alfred.Item) {
+	addItem := func(scale nest.TempScale, desc string) {
 		data := configMessage{Property: "scale", Scale: scale}
 		dataString, _ := json.Marshal(data)
 
@@ -205,7 +256,7 @@ func getScaleItems(prefix, query string, selected TempScale) (items []alfred.Ite
 			}, selected == scale))
 		}
 	}
-	addItem(ScaleC, "Use Celsius scale")
-	addItem(ScaleF, "Use Fahrenheit scale")
+	addItem(nest.ScaleC, tr("Use Celsius scale"))
+	addItem(nest.ScaleF, tr("Use Fahrenheit scale"))
 	return alfred.SortItemsForKeyword(items, query)
 }
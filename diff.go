@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// Change describes a single field that differs between two AllData snapshots.
+type Change struct {
+	Kind  string      `json:"kind"`
+	Id    string      `json:"id"`
+	Name  string      `json:"name"`
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s: %v -> %v", c.Name, c.Field, c.Old, c.New)
+}
+
+// diffAllData returns the watched fields that differ between two snapshots.
+// Target temperatures are compared and reported in the given scale, so each
+// setpoint change is one Change. Devices or structures that only appear in
+// one snapshot are ignored.
+func diffAllData(old, new nest.AllData, scale nest.TempScale) (changes []Change) {
+	var ids []string
+	for id := range new.Devices.Thermostats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		n := new.Devices.Thermostats[id]
+		o, ok := old.Devices.Thermostats[id]
+		if !ok {
+			continue
+		}
+
+		add := func(field string, oldValue, newValue interface{}) {
+			if oldValue != newValue {
+				changes = append(changes, Change{
+					Kind:  "thermostat",
+					Id:    id,
+					Name:  n.Name,
+					Field: field,
+					Old:   oldValue,
+					New:   newValue,
+				})
+			}
+		}
+
+		add("hvac_mode", o.HvacMode, n.HvacMode)
+		add("is_online", o.IsOnline, n.IsOnline)
+		add("is_using_emergency_heat", o.IsUsingEmergencyHeat, n.IsUsingEmergencyHeat)
+		add(nest.TargetTempField(scale, ""), o.TargetTemperature(scale), n.TargetTemperature(scale))
+		add(nest.TargetTempField(scale, nest.TypeHigh), o.TargetTemperatureHigh(scale),
+			n.TargetTemperatureHigh(scale))
+		add(nest.TargetTempField(scale, nest.TypeLow), o.TargetTemperatureLow(scale),
+			n.TargetTemperatureLow(scale))
+	}
+
+	ids = nil
+	for id := range new.Structures {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		n := new.Structures[id]
+		o, ok := old.Structures[id]
+		if !ok {
+			continue
+		}
+
+		if o.Away != n.Away {
+			changes = append(changes, Change{
+				Kind:  "structure",
+				Id:    id,
+				Name:  n.Name,
+				Field: "away",
+				Old:   o.Away,
+				New:   n.Away,
+			})
+		}
+	}
+
+	return
+}
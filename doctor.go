@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/go-alfred"
+)
+
+const (
+	// tokenExpiryWarning is how long before AccessExpiry the doctor starts
+	// warning about the token
+	tokenExpiryWarning = 7 * 24 * time.Hour
+	// staleConnection is how long a thermostat can go without connecting to
+	// Nest before the doctor flags it
+	staleConnection = time.Hour
+
+	doctorTimeout = 10 * time.Second
+)
+
+type CheckStatus string
+
+const (
+	CheckOk   = CheckStatus("ok")
+	CheckWarn = CheckStatus("warning")
+	CheckFail = CheckStatus("failed")
+)
+
+// Check is the result of one diagnostic check.
+type Check struct {
+	Name   string
+	Status CheckStatus
+	Detail string
+}
+
+func (c Check) String() string {
+	return fmt.Sprintf("[%s] %s: %s", c.Status, c.Name, c.Detail)
+}
+
+// runChecks diagnoses the active profile's token, files, default Nest,
+// thermostats, and connectivity to the Nest API.
+func runChecks() (checks []Check) {
+	add := func(name string, status CheckStatus, format string, args ...interface{}) {
+		checks = append(checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	// token
+	switch remaining := config.AccessExpiry.Sub(time.Now()); {
+	case !usesAccessToken(config.BackendUrl):
+		add("Token", CheckOk, "Not needed for %s", redactedBackendUrl())
+	case config.AccessToken == "":
+		add("Token", CheckFail, "No access token; run authorize")
+	case config.RefreshToken != "":
+		add("Token", CheckOk, "Expires at %s; refreshed automatically",
+			config.AccessExpiry.Local().Format(time.RFC822))
+	case remaining <= 0:
+		add("Token", CheckFail, "Expired at %s", config.AccessExpiry.Local().Format(time.RFC822))
+	case remaining < tokenExpiryWarning:
+		add("Token", CheckWarn, "Expires in %d hours", int(remaining.Hours()))
+	default:
+		add("Token", CheckOk, "Expires at %s", config.AccessExpiry.Local().Format(time.RFC822))
+	}
+
+	// files
+	checkFile := func(name, path string, v interface{}) {
+		data, err := ioutil.ReadFile(path)
+		switch {
+		case os.IsNotExist(err):
+			add(name, CheckWarn, "%s doesn’t exist", path)
+		case err != nil:
+			add(name, CheckFail, "%s", err)
+		default:
+			if err := decodeVersioned(data, v, migrationsFor(v)); err != nil {
+				add(name, CheckFail, "%s: %s", path, err)
+			} else {
+				add(name, CheckOk, "%s parses", path)
+			}
+		}
+	}
+	checkFile("Config", configFile, &Config{})
+	checkFile("Cache", cacheFile, &Cache{})
+
+	// default Nest
+	thermostats := cache.AllData.Devices.Thermostats
+	if config.NestId == "" {
+		add("Default Nest", CheckWarn, "None selected")
+	} else if t, ok := thermostats[config.NestId]; ok {
+		add("Default Nest", CheckOk, "%s (%s)", t.Name, t.DeviceId)
+	} else {
+		add("Default Nest", CheckFail, "%s isn’t in the cached data", config.NestId)
+	}
+
+	// thermostats
+	var ids []string
+	for id := range thermostats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		t := thermostats[id]
+		name := "Thermostat " + t.Name
+		age := time.Now().Sub(t.LastConnection)
+		switch {
+		case t.LastConnection.IsZero():
+			add(name, CheckWarn, "Has never connected")
+		case age >= staleConnection:
+			add(name, CheckWarn, "Last connected %s ago", formatDuration(age))
+		default:
+			add(name, CheckOk, "Last connected %s ago", formatDuration(age))
+		}
+	}
+
+	if config.BackendUrl != "" {
+		checks = append(checks, checkBackend())
+		return
+	}
+
+	// client version
+	if version := cache.AllData.Metadata.ClientVersion; version == 0 {
+		add("Client version", CheckWarn, "Unknown; refresh to load it")
+	} else if version != ClientVersion {
+		add("Client version", CheckWarn, "Token is for version %d but the workflow expects %d; "+
+			"authorize again", version, ClientVersion)
+	} else {
+		add("Client version", CheckOk, "%d", version)
+	}
+
+	checks = append(checks, checkApi()...)
+	return
+}
+
+// checkBackend reads everything from a backend other than Nest, reporting the
+// latency.
+func checkBackend() Check {
+	backend, err := openBackend()
+	if err != nil {
+		return Check{"Backend", CheckFail, err.Error()}
+	}
+
+	start := time.Now()
+	data, err := backend.GetAllData()
+	latency := time.Now().Sub(start) / time.Millisecond * time.Millisecond
+	if err != nil {
+		return Check{"Backend", CheckFail, fmt.Sprintf("%s: %s", redactedBackendUrl(), err)}
+	}
+	return Check{"Backend", CheckOk, fmt.Sprintf("%s returned %d thermostats in %s", redactedBackendUrl(),
+		len(data.Devices.Thermostats), latency)}
+}
+
+// redactedBackendUrl returns the backend URL without its password, if it has
+// one.
+func redactedBackendUrl() string {
+	u, err := url.Parse(config.BackendUrl)
+	if err != nil || u.User == nil {
+		return config.BackendUrl
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// checkApi requests the API root without following redirects, then requests
+// the redirect target, reporting the latency of each. Only hosts are reported
+// since URLs include the token.
+func checkApi() (checks []Check) {
+	client := &http.Client{
+		Timeout: doctorTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	probe := func(name, uri string) (resp *http.Response, ok bool) {
+		host := uri
+		if u, err := url.Parse(uri); err == nil {
+			host = u.Host
+		}
+
+		start := time.Now()
+		resp, err := client.Get(uri)
+		latency := time.Now().Sub(start) / time.Millisecond * time.Millisecond
+		if err != nil {
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			checks = append(checks, Check{name, CheckFail, fmt.Sprintf("%s unreachable: %s", host, err)})
+			return nil, false
+		}
+		resp.Body.Close()
+
+		status := CheckOk
+		if resp.StatusCode >= 400 {
+			status = CheckFail
+		}
+		checks = append(checks, Check{name, status, fmt.Sprintf("%s responded %s in %s", host,
+			resp.Status, latency)})
+		return resp, status == CheckOk
+	}
+
+	q := url.Values{}
+	q.Set("auth", config.AccessToken)
+	resp, ok := probe("API", nest.ApiHost+"/?"+q.Encode())
+	if !ok {
+		return
+	}
+
+	if resp.StatusCode == http.StatusTemporaryRedirect {
+		if location := resp.Header.Get("Location"); location != "" {
+			probe("API redirect", location)
+		}
+	}
+	return
+}
+
+// doctorReport renders checks as plain text for pasting into a bug report.
+// The token itself is never included.
+func doctorReport(checks []Check) string {
+	lines := []string{
+		"alfred-nest doctor report",
+		"Time: " + time.Now().Format(time.RFC3339),
+		"Profile: " + profile,
+		"",
+	}
+	for _, check := range checks {
+		lines = append(lines, check.String())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// copyToClipboard copies text with the first available clipboard tool.
+func copyToClipboard(text string) error {
+	tools := [][]string{
+		{"pbcopy"},
+		{"wl-copy"},
+		{"xclip", "-selection", "clipboard"},
+		{"xsel", "--clipboard", "--input"},
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(tool[0], tool[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	return fmt.Errorf("No clipboard tool found")
+}
+
+// doctor ------------------------------------------------
+
+type DoctorCommand struct{}
+
+func (c DoctorCommand) Keyword() string {
+	return "doctor"
+}
+
+func (c DoctorCommand) IsEnabled() bool {
+	return true
+}
+
+func (c DoctorCommand) MenuItem() alfred.Item {
+	return alfred.NewKeywordItem(c.Keyword(), "", " ", "Diagnose problems with the workflow")
+}
+
+// Items lists the result of every check, problems first, after an item that
+// copies the full report.
+func (c DoctorCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	checks := runChecks()
+
+	var problems int
+	for _, check := range checks {
+		if check.Status != CheckOk {
+			problems++
+		}
+	}
+
+	items = append(items, alfred.Item{
+		Title:       tr("Copy report"),
+		SubtitleAll: tr("%d checks, %d problems", len(checks), problems),
+		Arg:         "doctor",
+	})
+
+	var ok []alfred.Item
+	for _, check := range checks {
+		if check.Status == CheckOk {
+			ok = append(ok, alfred.Item{
+				Title:       check.Name,
+				SubtitleAll: check.Detail,
+				Valid:       alfred.Invalid,
+			})
+		} else {
+			items = append(items, alfred.Item{
+				Title:       WarningMarker + " " + check.Name,
+				SubtitleAll: check.Detail,
+				Valid:       alfred.Invalid,
+			})
+		}
+	}
+	items = append(items, ok...)
+
+	return
+}
+
+// Do copies the doctor report to the clipboard. If there's no clipboard, the
+// report is returned so it can be copied from the terminal.
+func (c DoctorCommand) Do(query string) (string, error) {
+	report := doctorReport(runChecks())
+	if err := copyToClipboard(report); err != nil {
+		return report, nil
+	}
+	return "Copied doctor report to clipboard", nil
+}
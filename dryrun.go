@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// In dry-run mode, writes aren't sent to the backend. Instead trackedBackend
+// records each write in the cache's Simulated overlay and applies it to the
+// cached data, and the overlay is re-applied after every refresh so reads keep
+// reflecting the simulated changes. The overlay is discarded on the first refresh after
+// dry-run mode is turned off.
+
+const DryRunEnv = "NEST_DRY_RUN"
+
+// isDryRun returns true if dry-run mode is enabled in the config or through
+// the NEST_DRY_RUN environment variable.
+func isDryRun() bool {
+	if value := os.Getenv(DryRunEnv); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		return err != nil || enabled
+	}
+	return config.DryRun
+}
+
+// markSimulated flags command output as simulated when in dry-run mode.
+func markSimulated(out string) string {
+	if isDryRun() && out != "" {
+		return tr("[Simulated] %s", out)
+	}
+	return out
+}
+
+// simulateWrite records a simulated write in the cache overlay.
+func simulateWrite(path string, data []byte) error {
+	return updateCache(func(c *Cache) error {
+		if c.Simulated == nil {
+			c.Simulated = map[string]json.RawMessage{}
+		}
+		c.Simulated[path] = json.RawMessage(data)
+		return applySimulatedWrite(&c.AllData, path, data)
+	})
+}
+
+// applySimulatedWrites applies every write in an overlay to data.
+func applySimulatedWrites(data *nest.AllData, overlay map[string]json.RawMessage) {
+	for path, value := range overlay {
+		if err := applySimulatedWrite(data, path, value); err != nil {
+			log.Printf("Error applying simulated write to %s: %s", path, err)
+		}
+	}
+}
+
+// applySimulatedWrite sets the field addressed by an API path in data. When a
+// temperature is set in one scale, the equivalent field in the other scale is
+// updated too.
+func applySimulatedWrite(data *nest.AllData, path string, value json.RawMessage) error {
+	collection, id, field := parseApiPath(path)
+
+	switch collection {
+	case "thermostats":
+		t, ok := data.Devices.Thermostats[id]
+		if !ok {
+			return errors.New("Unknown thermostat '" + id + "'")
+		}
+		fields := map[string]json.RawMessage{field: value}
+		if other, converted, ok := convertTempField(field, value); ok {
+			fields[other] = converted
+		}
+		if err := setJsonFields(&t, fields); err != nil {
+			return err
+		}
+		data.Devices.Thermostats[id] = t
+
+	case "structures":
+		s, ok := data.Structures[id]
+		if !ok {
+			return errors.New("Unknown structure '" + id + "'")
+		}
+		if err := setJsonFields(&s, map[string]json.RawMessage{field: value}); err != nil {
+			return err
+		}
+		data.Structures[id] = s
+
+	default:
+		return errors.New("Unsupported path '" + path + "'")
+	}
+
+	return nil
+}
+
+// setJsonFields sets fields of v by their JSON names.
+func setJsonFields(v interface{}, fields map[string]json.RawMessage) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var current map[string]json.RawMessage
+	if err := json.Unmarshal(data, &current); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		current[name] = value
+	}
+
+	if data, err = json.Marshal(current); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// convertTempField converts the value of a Fahrenheit or Celsius temperature
+// field to the other scale, returning the other field's name and value.
+func convertTempField(field string, value json.RawMessage) (string, json.RawMessage, bool) {
+	if !strings.Contains(field, "temperature") {
+		return "", nil, false
+	}
+
+	var temp float64
+	if err := json.Unmarshal(value, &temp); err != nil {
+		return "", nil, false
+	}
+
+	var other string
+	switch {
+	case strings.HasSuffix(field, "_f"):
+		other = strings.TrimSuffix(field, "_f") + "_c"
+		// Nest uses half-degree steps for Celsius
+		temp = math.Floor((temp-32)*5/9*2+0.5) / 2
+	case strings.HasSuffix(field, "_c"):
+		other = strings.TrimSuffix(field, "_c") + "_f"
+		temp = math.Floor(temp*9/5 + 32 + 0.5)
+	default:
+		return "", nil, false
+	}
+
+	converted, _ := json.Marshal(temp)
+	return other, converted, true
+}
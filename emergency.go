@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/go-alfred"
+)
+
+// Heat pumps fall back to emergency (auxiliary) heat when they can't keep up,
+// which is expensive. Each refresh records when a thermostat started using
+// emergency heat, and once it's been on longer than the configured limit an
+// alert is raised: a webhook is sent, the configured alert command is run, and
+// status items show a warning.
+
+const DefaultEmergencyHeatMinutes = 30
+
+// AlertEnv is the environment variable that holds the alert message when the
+// alert command is run.
+const AlertEnv = "NEST_ALERT"
+
+// EmergencyHeat records when a thermostat started using emergency heat and
+// whether an alert has been raised for it.
+type EmergencyHeat struct {
+	Since   time.Time
+	Alerted bool `json:",omitempty"`
+}
+
+// emergencyHeatLimit returns how long emergency heat may run before an alert.
+func emergencyHeatLimit() time.Duration {
+	if config.EmergencyHeatMinutes <= 0 {
+		return DefaultEmergencyHeatMinutes * time.Minute
+	}
+	return time.Duration(config.EmergencyHeatMinutes) * time.Minute
+}
+
+// trackEmergencyHeat updates the emergency heat state of every thermostat in a
+// freshly refreshed cache, and returns alerts for thermostats that have just
+// passed the limit.
+func trackEmergencyHeat(c *Cache) (alerts []string) {
+	now := time.Now()
+	state := map[string]EmergencyHeat{}
+
+	var ids []string
+	for id := range c.AllData.Devices.Thermostats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		t := c.AllData.Devices.Thermostats[id]
+		if !t.IsUsingEmergencyHeat {
+			continue
+		}
+
+		heat, ok := c.EmergencyHeat[id]
+		if !ok {
+			heat.Since = now
+		}
+		if !heat.Alerted && now.Sub(heat.Since) >= emergencyHeatLimit() {
+			heat.Alerted = true
+			alerts = append(alerts, fmt.Sprintf("%s has been using emergency heat for %s", t.Name,
+				formatMinutes(now.Sub(heat.Since))))
+		}
+		state[id] = heat
+	}
+
+	c.EmergencyHeat = state
+	return
+}
+
+// notifyAlerts sends alerts to the webhooks and the alert command.
+func notifyAlerts(alerts []string) {
+	if len(alerts) == 0 {
+		return
+	}
+
+	sendWebhooks(webhookPayload{Time: time.Now(), Alerts: alerts})
+
+	if config.AlertCommand == "" {
+		return
+	}
+	for _, alert := range alerts {
+		cmd := exec.Command("/bin/sh", "-c", config.AlertCommand)
+		cmd.Env = append(os.Environ(), AlertEnv+"="+alert)
+		if err := cmd.Start(); err != nil {
+			log.Println("Error running alert command:", err)
+		}
+	}
+}
+
+// emergencyHeatDuration returns how long a thermostat has been using emergency
+// heat, according to the cache.
+func emergencyHeatDuration(deviceId string) (time.Duration, bool) {
+	heat, ok := cache.EmergencyHeat[deviceId]
+	if !ok {
+		return 0, false
+	}
+	return time.Now().Sub(heat.Since), true
+}
+
+// getEmergencyHeatItem returns an item describing a thermostat's emergency
+// heat, which is a warning if it's been on longer than the limit. ok is false
+// if emergency heat isn't on.
+func getEmergencyHeatItem(thermostat *nest.Thermostat) (item alfred.Item, ok bool) {
+	if !thermostat.IsUsingEmergencyHeat {
+		return
+	}
+
+	item = alfred.Item{
+		Title:       tr("Emergency heat is on"),
+		SubtitleAll: tr("Auxiliary heat is expensive to run"),
+		Valid:       alfred.Invalid,
+		Icon:        IconHeat,
+	}
+
+	if duration, known := emergencyHeatDuration(thermostat.DeviceId); known {
+		item.SubtitleAll = tr("On for %s", formatMinutes(duration))
+		if duration >= emergencyHeatLimit() {
+			item.Title = WarningMarker + " " + tr("%s: emergency heat on for %s", thermostat.Name,
+				formatMinutes(duration))
+			item.SubtitleAll = tr("Auxiliary heat is expensive to run")
+		}
+	}
+
+	return item, true
+}
+
+func formatMinutes(d time.Duration) string {
+	minutes := int(d.Minutes())
+	if minutes == 1 {
+		return tr("1 minute")
+	}
+	return tr("%d minutes", minutes)
+}
+
+// formatDuration formats a duration in minutes, hours or days, whichever is
+// the largest unit that fits.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Hour:
+		return formatMinutes(d)
+	case d < 2*time.Hour:
+		return tr("1 hour")
+	case d < 24*time.Hour:
+		return tr("%d hours", int(d.Hours()))
+	case d < 48*time.Hour:
+		return tr("1 day")
+	}
+	return tr("%d days", int(d.Hours()/24))
+}
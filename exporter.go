@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/go-alfred"
+)
+
+const ExporterAddress = ":9142"
+
+// exporter ----------------------------------------------
+
+type ExporterCommand struct{}
+
+func (c ExporterCommand) Keyword() string {
+	return "exporter"
+}
+
+func (c ExporterCommand) IsEnabled() bool {
+	return isAuthorized()
+}
+
+func (c ExporterCommand) MenuItem() alfred.Item {
+	return alfred.Item{
+		Title:        c.Keyword(),
+		Autocomplete: c.Keyword(),
+		Arg:          "exporter",
+		SubtitleAll:  "Serve Prometheus metrics on " + ExporterAddress,
+	}
+}
+
+func (c ExporterCommand) Items(prefix, query string) ([]alfred.Item, error) {
+	return []alfred.Item{c.MenuItem()}, nil
+}
+
+// Do starts a metrics server. The listen address may be given as the query;
+// it defaults to ExporterAddress.
+func (c ExporterCommand) Do(query string) (string, error) {
+	addr := strings.TrimSpace(query)
+	if addr == "" {
+		addr = ExporterAddress
+	}
+	return "", StartExporter(addr)
+}
+
+// StartExporter serves Prometheus metrics at /metrics on the given address.
+// Data is read through checkRefreshNow, so scrapes are served from the cache and
+// only reach the Nest API when the cache is stale.
+func StartExporter(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	log.Println("Serving metrics on", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// scrapeLock serializes scrapes, since refreshing updates the global cache.
+var scrapeLock sync.Mutex
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	scrapeLock.Lock()
+	defer scrapeLock.Unlock()
+
+	refreshErr := checkRefreshNow()
+	if refreshErr != nil {
+		log.Println("Error refreshing for scrape:", refreshErr)
+	}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, refreshErr == nil)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+type thermostatGauge struct {
+	name  string
+	help  string
+	value func(t *nest.Thermostat) float64
+}
+
+var thermostatGauges = []thermostatGauge{
+	{"nest_ambient_temperature", "Ambient temperature", func(t *nest.Thermostat) float64 {
+		return t.AmbientTemperature(config.Scale).Value()
+	}},
+	{"nest_target_temperature", "Target temperature", func(t *nest.Thermostat) float64 {
+		return t.TargetTemperature(config.Scale).Value()
+	}},
+	{"nest_target_temperature_high", "Upper target temperature in heat-cool mode", func(t *nest.Thermostat) float64 {
+		return t.TargetTemperatureHigh(config.Scale).Value()
+	}},
+	{"nest_target_temperature_low", "Lower target temperature in heat-cool mode", func(t *nest.Thermostat) float64 {
+		return t.TargetTemperatureLow(config.Scale).Value()
+	}},
+	{"nest_away_temperature_high", "Upper away temperature", func(t *nest.Thermostat) float64 {
+		return t.AwayTemperatureHigh(config.Scale).Value()
+	}},
+	{"nest_away_temperature_low", "Lower away temperature", func(t *nest.Thermostat) float64 {
+		return t.AwayTemperatureLow(config.Scale).Value()
+	}},
+	{"nest_humidity_percent", "Relative humidity", func(t *nest.Thermostat) float64 {
+		return float64(t.Humidity)
+	}},
+	{"nest_online", "Whether the thermostat is online", func(t *nest.Thermostat) float64 {
+		return boolGauge(t.IsOnline)
+	}},
+}
+
+var hvacModes = []nest.HvacMode{nest.ModeHeat, nest.ModeCool, nest.ModeRange, nest.ModeOff}
+var presences = []nest.Presence{nest.Home, nest.Away, nest.AutoAway}
+
+// writeMetrics writes the cached thermostat and structure state, followed by
+// the API counters, in Prometheus text format.
+func writeMetrics(buf *bytes.Buffer, refreshOk bool) {
+	data := cache.AllData
+	gauges := newGaugeWriter(buf)
+
+	var ids []string
+	for id := range data.Devices.Thermostats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	labelsFor := func(t *nest.Thermostat) metricLabels {
+		return metricLabels{
+			"device":    t.Name,
+			"device_id": t.DeviceId,
+			"structure": data.Structures[t.StructureId].Name,
+			"scale":     string(config.Scale),
+		}
+	}
+
+	for _, g := range thermostatGauges {
+		for _, id := range ids {
+			t := data.Devices.Thermostats[id]
+			gauges.write(g.name, g.help, labelsFor(&t), g.value(&t))
+		}
+	}
+
+	for _, id := range ids {
+		t := data.Devices.Thermostats[id]
+		for _, mode := range hvacModes {
+			labels := labelsFor(&t)
+			delete(labels, "scale")
+			labels["mode"] = string(mode)
+			gauges.write("nest_hvac_mode", "Current HVAC mode", labels, boolGauge(t.HvacMode == mode))
+		}
+	}
+
+	var structureIds []string
+	for id := range data.Structures {
+		structureIds = append(structureIds, id)
+	}
+	sort.Strings(structureIds)
+
+	for _, id := range structureIds {
+		s := data.Structures[id]
+		for _, presence := range presences {
+			labels := metricLabels{"structure": s.Name, "structure_id": s.StructureId, "state": string(presence)}
+			gauges.write("nest_structure_away", "Current structure presence state", labels, boolGauge(s.Away == presence))
+		}
+	}
+
+	gauges.write("nest_cache_timestamp_seconds", "Time of the last successful refresh", nil,
+		float64(cache.Time.Unix()))
+	gauges.write("nest_refresh_ok", "Whether the last scrape-triggered refresh succeeded", nil,
+		boolGauge(refreshOk))
+
+	apiCalls.write(buf, "nest_api_requests_total", "Requests made to the thermostat backend")
+	apiErrors.write(buf, "nest_api_errors_total", "Failed requests made to the thermostat backend")
+}
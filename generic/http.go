@@ -0,0 +1,78 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const httpTimeout = 10 * time.Second
+
+// httpTransport reads a State document from a URL and POSTs commands below
+// it.
+type httpTransport struct {
+	url       string
+	requested func(method string, err error)
+}
+
+var httpClient = &http.Client{Timeout: httpTimeout}
+
+func (h *httpTransport) state() (state State, err error) {
+	resp, err := httpClient.Get(h.url)
+	if err != nil {
+		h.done("GET", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	err = checkResponse(resp)
+	h.done("GET", err)
+	if err != nil {
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return
+}
+
+func (h *httpTransport) send(id string, cmd Command) error {
+	path := "/presence"
+	if id != "" {
+		path = "/thermostats/" + url.PathEscape(id)
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Post(strings.TrimSuffix(h.url, "/")+path, "application/json",
+		bytes.NewReader(data))
+	if err != nil {
+		h.done("POST", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = checkResponse(resp)
+	h.done("POST", err)
+	return err
+}
+
+func (h *httpTransport) done(method string, err error) {
+	if h.requested != nil {
+		h.requested(method, err)
+	}
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 400 {
+		content, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(content)))
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package generic
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// request is an HTTP request received by a test server.
+type request struct {
+	method      string
+	path        string
+	contentType string
+	body        string
+}
+
+// newTestBackend returns a backend reading from a server that replies to GETs
+// with state, and a channel receiving each POST the server gets.
+func newTestBackend(t *testing.T, status int, state string) (*Backend, <-chan request) {
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			data, _ := ioutil.ReadAll(r.Body)
+			requests <- request{
+				method:      r.Method,
+				path:        r.URL.Path,
+				contentType: r.Header.Get("Content-Type"),
+				body:        string(data),
+			}
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(state))
+	}))
+	t.Cleanup(server.Close)
+
+	backend, err := Open(server.URL + "/state/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend, requests
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://host/state", true},
+		{"https://host/state", true},
+		{"mqtt://broker/prefix", true},
+		{"mqtts://broker", true},
+		{"ftp://host", false},
+		{"::", false},
+	}
+
+	for _, test := range tests {
+		_, err := Open(test.url)
+		if (err == nil) != test.ok {
+			t.Errorf("Open(%q) returned %v", test.url, err)
+		}
+	}
+}
+
+func TestHttpState(t *testing.T) {
+	backend, _ := newTestBackend(t, http.StatusOK, `{
+		"presence": "away",
+		"thermostats": [
+			{"id": "t1", "name": "Hall", "scale": "F", "mode": "heat-cool", "ambient": 70,
+				"humidity": 40, "target_low": 66, "target_high": 76, "online": false},
+			{"id": "t2", "name": "Attic", "mode": "cool", "ambient": 25.3, "target": 24,
+				"can_heat": false, "has_fan": true}
+		]
+	}`)
+
+	data, err := backend.GetAllData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	structure := data.Structures[StructureId]
+	if structure.Away != nest.Away || len(structure.Thermostats) != 2 {
+		t.Errorf("got structure %+v", structure)
+	}
+
+	hall, attic := data.Devices.Thermostats["t1"], data.Devices.Thermostats["t2"]
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"hall Name", hall.Name, "Hall"},
+		{"hall IsOnline", hall.IsOnline, false},
+		{"hall HvacMode", hall.HvacMode, nest.ModeRange},
+		{"hall Humidity", hall.Humidity, nest.Humidity(40)},
+		{"hall AmbientTemperatureF", hall.AmbientTemperatureF, nest.TempF(70)},
+		{"hall AmbientTemperatureC", hall.AmbientTemperatureC, nest.TempC(21)},
+		{"hall TargetTemperatureLowF", hall.TargetTemperatureLowF, nest.TempF(66)},
+		{"hall TargetTemperatureHighC", hall.TargetTemperatureHighC, nest.TempC(24.5)},
+		{"attic TemperatureScale", attic.TemperatureScale, nest.ScaleC},
+		{"attic AmbientTemperatureC", attic.AmbientTemperatureC, nest.TempC(25.5)},
+		{"attic TargetTemperatureF", attic.TargetTemperatureF, nest.TempF(75)},
+		{"attic CanHeat", attic.CanHeat, false},
+		{"attic CanCool", attic.CanCool, true},
+		{"attic HasFan", attic.HasFan, true},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestHttpCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(b *Backend) error
+		want request
+	}{
+		{
+			name: "target",
+			call: func(b *Backend) error {
+				_, err := b.SetTargetTemp("t1", nest.TempF(70), "")
+				return err
+			},
+			want: request{path: "/state/thermostats/t1", body: `{"scale":"F","target":70}`},
+		},
+		{
+			name: "range",
+			call: func(b *Backend) error {
+				return b.SetTargetRange("t 1", nest.TempC(19), nest.TempC(24.5))
+			},
+			want: request{path: "/state/thermostats/t 1",
+				body: `{"scale":"C","target_low":19,"target_high":24.5}`},
+		},
+		{
+			name: "mode",
+			call: func(b *Backend) error { return b.SetHvacMode("t1", nest.ModeOff) },
+			want: request{path: "/state/thermostats/t1", body: `{"mode":"off"}`},
+		},
+		{
+			name: "fan",
+			call: func(b *Backend) error { return b.SetFanTimer("t1", true) },
+			want: request{path: "/state/thermostats/t1", body: `{"fan":true}`},
+		},
+		{
+			name: "presence",
+			call: func(b *Backend) error { return b.SetPresence(StructureId, nest.Away) },
+			want: request{path: "/state/presence", body: `{"presence":"away"}`},
+		},
+	}
+
+	for _, test := range tests {
+		backend, requests := newTestBackend(t, http.StatusOK, "")
+		if err := test.call(backend); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		got := <-requests
+		test.want.method = "POST"
+		test.want.contentType = "application/json"
+		if got != test.want {
+			t.Errorf("%s: got request %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHttpErrors(t *testing.T) {
+	backend, requests := newTestBackend(t, http.StatusBadRequest, "target out of range\n")
+
+	if _, err := backend.GetAllData(); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("GetAllData returned %v, want 400", err)
+	}
+
+	err := backend.SetHvacMode("t1", nest.ModeHeat)
+	if err == nil || err.Error() != "400 Bad Request: target out of range" {
+		t.Errorf("SetHvacMode returned %v, want the server's message", err)
+	}
+	<-requests
+
+	if err := backend.SetPresence("elsewhere", nest.Away); err == nil {
+		t.Error("SetPresence accepted an unknown structure")
+	}
+	if len(requests) != 0 {
+		t.Error("SetPresence sent a request for an unknown structure")
+	}
+}
+
+func TestHttpOnRequest(t *testing.T) {
+	backend, requests := newTestBackend(t, http.StatusInternalServerError, "")
+	var methods []string
+	backend.OnRequest = func(method string, err error) {
+		if err != nil {
+			method += " failed"
+		}
+		methods = append(methods, method)
+	}
+
+	backend.GetAllData()
+	backend.SetFanTimer("t1", false)
+	<-requests
+
+	want := []string{"GET failed", "POST failed"}
+	if strings.Join(methods, ",") != strings.Join(want, ",") {
+		t.Errorf("OnRequest got %v, want %v", methods, want)
+	}
+}
@@ -0,0 +1,333 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// This is just enough of MQTT 3.1.1 to publish a message or collect retained
+// messages, with a new connection for each.
+
+const (
+	mqttTimeout = 10 * time.Second
+	// mqttQuiet is how long to wait for more retained messages after the last
+	// one; brokers send them all immediately after a subscription
+	mqttQuiet = 500 * time.Millisecond
+
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttSubscribe  = 0x82
+	mqttSuback     = 0x90
+	mqttDisconnect = 0xe0
+)
+
+// mqttTransport reads retained state messages from an MQTT broker and
+// publishes commands to it.
+type mqttTransport struct {
+	addr     string
+	tls      bool
+	username string
+	password *string
+	prefix   string
+
+	requested func(method string, err error)
+}
+
+func newMqttTransport(u *url.URL) *mqttTransport {
+	m := &mqttTransport{
+		addr:   u.Host,
+		tls:    u.Scheme == "mqtts",
+		prefix: strings.Trim(u.Path, "/"),
+	}
+	if u.Port() == "" {
+		if m.tls {
+			m.addr += ":8883"
+		} else {
+			m.addr += ":1883"
+		}
+	}
+	if u.User != nil {
+		m.username = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			m.password = &password
+		}
+	}
+	return m
+}
+
+func (m *mqttTransport) topic(parts ...string) string {
+	if m.prefix != "" {
+		parts = append([]string{m.prefix}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (m *mqttTransport) state() (state State, err error) {
+	messages, err := m.retained(m.topic("#"))
+	if err != nil {
+		return
+	}
+
+	devicePrefix := m.topic("thermostats") + "/"
+	var topics []string
+	for topic := range messages {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		payload := messages[topic]
+		switch {
+		case topic == m.topic("presence"):
+			state.Presence = nest.Presence(strings.Trim(string(payload), "\" \n"))
+		case strings.HasPrefix(topic, devicePrefix) && !strings.HasSuffix(topic, "/set"):
+			var device Device
+			if err := json.Unmarshal(payload, &device); err != nil {
+				log.Printf("Ignoring invalid device state on %s: %s", topic, err)
+				continue
+			}
+			if device.Id == "" {
+				device.Id = strings.TrimPrefix(topic, devicePrefix)
+			}
+			state.Thermostats = append(state.Thermostats, device)
+		}
+	}
+	return
+}
+
+func (m *mqttTransport) send(id string, cmd Command) error {
+	if id == "" {
+		return m.publish(m.topic("presence", "set"), []byte(cmd.Presence))
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return m.publish(m.topic("thermostats", id, "set"), data)
+}
+
+// connect opens a connection to the broker and completes the MQTT handshake.
+func (m *mqttTransport) connect() (conn net.Conn, r *bufio.Reader, err error) {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	if m.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(mqttTimeout))
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	if err = writeMqttPacket(conn, mqttConnect, m.connectBody("alfred-nest-"+hex.EncodeToString(id))); err != nil {
+		conn.Close()
+		return
+	}
+
+	r = bufio.NewReader(conn)
+	kind, payload, err := readMqttPacket(r)
+	if err == nil && (kind != mqttConnack || len(payload) < 2) {
+		err = errors.New("Unexpected response from MQTT broker")
+	} else if err == nil && payload[1] != 0 {
+		err = fmt.Errorf("MQTT broker refused connection (code %d)", payload[1])
+	}
+	if err != nil {
+		conn.Close()
+	}
+	return
+}
+
+// connectBody returns the body of a CONNECT packet. MQTT 3.1.1 only allows a
+// password with a username, so a password alone is left out.
+func (m *mqttTransport) connectBody(clientId string) []byte {
+	var body bytes.Buffer
+	writeMqttString(&body, "MQTT")
+	body.WriteByte(4)   // protocol level 3.1.1
+	flags := byte(0x02) // clean session
+	if m.username != "" {
+		flags |= 0x80
+		if m.password != nil {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(mqttTimeout/time.Second))
+	writeMqttString(&body, clientId)
+	if flags&0x80 != 0 {
+		writeMqttString(&body, m.username)
+	}
+	if flags&0x40 != 0 {
+		writeMqttString(&body, *m.password)
+	}
+	return body.Bytes()
+}
+
+func (m *mqttTransport) done(method string, err error) {
+	if m.requested != nil {
+		m.requested(method, err)
+	}
+}
+
+// publish sends a message with QoS 0.
+func (m *mqttTransport) publish(topic string, payload []byte) (err error) {
+	defer func() { m.done("PUBLISH", err) }()
+
+	conn, _, err := m.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var body bytes.Buffer
+	writeMqttString(&body, topic)
+	body.Write(payload)
+	if err := writeMqttPacket(conn, mqttPublish, body.Bytes()); err != nil {
+		return err
+	}
+	return writeMqttPacket(conn, mqttDisconnect, nil)
+}
+
+// retained subscribes to a topic filter and returns the retained messages the
+// broker sends, keyed by topic. Live messages published to the filter are
+// ignored. Reading stops once no retained message has arrived for mqttQuiet,
+// or at the latest mqttTimeout after subscribing, so a busy topic can't keep
+// it reading.
+func (m *mqttTransport) retained(filter string) (messages map[string][]byte, err error) {
+	defer func() { m.done("SUBSCRIBE", err) }()
+
+	conn, r, err := m.connect()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, uint16(1))
+	writeMqttString(&body, filter)
+	body.WriteByte(0) // QoS 0
+	if err = writeMqttPacket(conn, mqttSubscribe, body.Bytes()); err != nil {
+		return
+	}
+
+	messages = map[string][]byte{}
+	deadline := time.Now().Add(mqttTimeout)
+	subscribed := false
+	quiet := func() {
+		if end := time.Now().Add(mqttQuiet); end.Before(deadline) {
+			conn.SetReadDeadline(end)
+		} else {
+			conn.SetReadDeadline(deadline)
+		}
+	}
+
+	for {
+		kind, payload, err := readMqttPacket(r)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && subscribed {
+				break
+			}
+			return nil, err
+		}
+
+		switch kind & 0xf0 {
+		case mqttSuback:
+			subscribed = true
+			quiet()
+		case mqttPublish:
+			if kind&0x01 == 0 {
+				// not retained
+				continue
+			}
+			if len(payload) < 2 {
+				continue
+			}
+			length := int(binary.BigEndian.Uint16(payload))
+			if len(payload) < 2+length {
+				continue
+			}
+			topic := string(payload[2 : 2+length])
+			rest := payload[2+length:]
+			if qos := (kind >> 1) & 0x03; qos > 0 && len(rest) >= 2 {
+				// skip the packet identifier
+				rest = rest[2:]
+			}
+			messages[topic] = rest
+			if subscribed {
+				quiet()
+			}
+		}
+	}
+
+	writeMqttPacket(conn, mqttDisconnect, nil)
+	return messages, nil
+}
+
+func writeMqttString(w *bytes.Buffer, s string) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.WriteString(s)
+}
+
+func writeMqttPacket(w io.Writer, kind byte, body []byte) error {
+	header := []byte{kind}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		header = append(header, b)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(header, body...))
+	return err
+}
+
+func readMqttPacket(r *bufio.Reader) (kind byte, body []byte, err error) {
+	if kind, err = r.ReadByte(); err != nil {
+		return
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			return
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("Malformed MQTT packet length")
+		}
+		multiplier *= 128
+	}
+
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return
+}
@@ -0,0 +1,351 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+func TestMqttPacketLength(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{321, []byte{0xc1, 0x02}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+
+	for _, test := range tests {
+		body := bytes.Repeat([]byte{'x'}, test.length)
+		var buf bytes.Buffer
+		if err := writeMqttPacket(&buf, mqttPublish, body); err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		want := append([]byte{mqttPublish}, test.header...)
+		if !bytes.Equal(data[:len(want)], want) {
+			t.Errorf("length %d: header is % x, want % x", test.length, data[:len(want)], want)
+		}
+
+		kind, got, err := readMqttPacket(bufio.NewReader(&buf))
+		if err != nil {
+			t.Errorf("length %d: %s", test.length, err)
+		} else if kind != mqttPublish || !bytes.Equal(got, body) {
+			t.Errorf("length %d: read back kind %x, %d bytes", test.length, kind, len(got))
+		}
+	}
+}
+
+func TestReadMqttPacketErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no length", []byte{mqttConnack}},
+		{"length too long", []byte{mqttPublish, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"short body", []byte{mqttConnack, 0x02, 0x00}},
+	}
+
+	for _, test := range tests {
+		if _, _, err := readMqttPacket(bufio.NewReader(bytes.NewReader(test.data))); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestConnectBody(t *testing.T) {
+	// header: "MQTT", level 4, then flags at index 7
+	header := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04}
+	keepAlive := []byte{0x00, byte(mqttTimeout / time.Second)}
+	clientId := []byte{0x00, 0x02, 'i', 'd'}
+
+	tests := []struct {
+		url     string
+		flags   byte
+		payload []byte
+	}{
+		{"mqtt://broker", 0x02, nil},
+		{"mqtt://user@broker", 0x82, []byte{0x00, 0x04, 'u', 's', 'e', 'r'}},
+		{"mqtt://user:pw@broker", 0xc2, []byte{0x00, 0x04, 'u', 's', 'e', 'r', 0x00, 0x02, 'p', 'w'}},
+		{"mqtt://user:@broker", 0xc2, []byte{0x00, 0x04, 'u', 's', 'e', 'r', 0x00, 0x00}},
+		// a password without a username isn't allowed
+		{"mqtt://:pw@broker", 0x02, nil},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		got := newMqttTransport(u).connectBody("id")
+
+		var want []byte
+		want = append(want, header...)
+		want = append(want, test.flags)
+		want = append(want, keepAlive...)
+		want = append(want, clientId...)
+		want = append(want, test.payload...)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: CONNECT body is % x, want % x", test.url, got, want)
+		}
+	}
+}
+
+func TestNewMqttTransport(t *testing.T) {
+	tests := []struct {
+		url    string
+		addr   string
+		tls    bool
+		prefix string
+	}{
+		{"mqtt://broker", "broker:1883", false, ""},
+		{"mqtts://broker/home/thermostats/", "broker:8883", true, "home/thermostats"},
+		{"mqtt://broker:1884/prefix", "broker:1884", false, "prefix"},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		m := newMqttTransport(u)
+		if m.addr != test.addr || m.tls != test.tls || m.prefix != test.prefix {
+			t.Errorf("%s: got %s, %v, %q; want %s, %v, %q", test.url, m.addr, m.tls, m.prefix, test.addr,
+				test.tls, test.prefix)
+		}
+	}
+}
+
+// broker is a stand-in MQTT broker. Each connection is handed to handle
+// after the CONNECT has been read and answered with a CONNACK carrying code.
+type broker struct {
+	listener net.Listener
+	code     byte
+	handle   func(conn net.Conn, r *bufio.Reader)
+	connects chan []byte
+}
+
+func newBroker(t *testing.T, handle func(conn net.Conn, r *bufio.Reader)) *broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	b := &broker{listener: listener, handle: handle, connects: make(chan []byte, 10)}
+	go b.serve()
+	return b
+}
+
+func (b *broker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			kind, body, err := readMqttPacket(r)
+			if err != nil || kind != mqttConnect {
+				return
+			}
+			b.connects <- body
+			writeMqttPacket(conn, mqttConnack, []byte{0, b.code})
+			if b.code == 0 && b.handle != nil {
+				b.handle(conn, r)
+			}
+		}()
+	}
+}
+
+func (b *broker) transport(prefix string) *mqttTransport {
+	u, _ := url.Parse("mqtt://user:pw@" + b.listener.Addr().String() + "/" + prefix)
+	return newMqttTransport(u)
+}
+
+// publishPacket returns a PUBLISH packet's flags and body.
+func publishPacket(topic, payload string, retain bool, qos byte) (byte, []byte) {
+	kind := byte(mqttPublish) | qos<<1
+	if retain {
+		kind |= 0x01
+	}
+	var body bytes.Buffer
+	writeMqttString(&body, topic)
+	if qos > 0 {
+		binary.Write(&body, binary.BigEndian, uint16(7))
+	}
+	body.WriteString(payload)
+	return kind, body.Bytes()
+}
+
+// subscribed reads a SUBSCRIBE packet, answers it and returns its topic filter.
+func subscribed(t *testing.T, conn net.Conn, r *bufio.Reader) string {
+	kind, body, err := readMqttPacket(r)
+	if err != nil || kind != mqttSubscribe || len(body) < 4 {
+		t.Errorf("expected SUBSCRIBE, got %x % x %v", kind, body, err)
+		return ""
+	}
+	length := int(binary.BigEndian.Uint16(body[2:]))
+	writeMqttPacket(conn, mqttSuback, []byte{body[0], body[1], 0})
+	return string(body[4 : 4+length])
+}
+
+func TestRetained(t *testing.T) {
+	filters := make(chan string, 1)
+	b := newBroker(t, func(conn net.Conn, r *bufio.Reader) {
+		filters <- subscribed(t, conn, r)
+		for _, p := range []struct {
+			topic, payload string
+			retain         bool
+			qos            byte
+		}{
+			{"a", "one", true, 0},
+			{"b", "two", true, 1},
+			{"live", "ignored", false, 0},
+			{"a", "three", true, 0},
+		} {
+			kind, body := publishPacket(p.topic, p.payload, p.retain, p.qos)
+			writeMqttPacket(conn, kind, body)
+		}
+		readMqttPacket(r)
+	})
+
+	messages, err := b.transport("").retained("#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter := <-filters; filter != "#" {
+		t.Errorf("subscribed to %q, want #", filter)
+	}
+	if len(messages) != 2 || string(messages["a"]) != "three" || string(messages["b"]) != "two" {
+		t.Errorf("got messages %q, want a=three, b=two", messages)
+	}
+
+	connect := <-b.connects
+	if !bytes.Contains(connect, []byte("user")) || !bytes.Contains(connect, []byte("pw")) {
+		t.Errorf("CONNECT % x doesn't carry the credentials", connect)
+	}
+}
+
+func TestRetainedBusyTopic(t *testing.T) {
+	done := make(chan bool)
+	t.Cleanup(func() { close(done) })
+
+	b := newBroker(t, func(conn net.Conn, r *bufio.Reader) {
+		subscribed(t, conn, r)
+		kind, body := publishPacket("state", "retained", true, 0)
+		writeMqttPacket(conn, kind, body)
+
+		// live messages shouldn't keep the client reading
+		kind, body = publishPacket("state", "live", false, 0)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(mqttQuiet / 5):
+				if writeMqttPacket(conn, kind, body) != nil {
+					return
+				}
+			}
+		}
+	})
+
+	start := time.Now()
+	messages, err := b.transport("").retained("#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 3*mqttQuiet {
+		t.Errorf("took %s to collect retained messages", elapsed)
+	}
+	if len(messages) != 1 || string(messages["state"]) != "retained" {
+		t.Errorf("got messages %q, want state=retained", messages)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	b := newBroker(t, nil)
+	b.code = 5
+
+	_, err := b.transport("").retained("#")
+	if err == nil || !strings.Contains(err.Error(), "code 5") {
+		t.Errorf("got error %v, want refused connection", err)
+	}
+}
+
+func TestMqttBackend(t *testing.T) {
+	published := make(chan [2]string, 10)
+	b := newBroker(t, func(conn net.Conn, r *bufio.Reader) {
+		kind, body, err := readMqttPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch kind {
+		case mqttSubscribe:
+			writeMqttPacket(conn, mqttSuback, []byte{body[0], body[1], 0})
+			for _, p := range [][2]string{
+				{"home/thermostats/t1", `{"name":"Hall","mode":"heat","ambient":20,"target":21}`},
+				{"home/thermostats/t1/set", `{"target":30}`},
+				{"home/presence", "away"},
+				{"other/presence", "home"},
+			} {
+				kind, body := publishPacket(p[0], p[1], true, 0)
+				writeMqttPacket(conn, kind, body)
+			}
+			readMqttPacket(r)
+		case mqttPublish:
+			length := int(binary.BigEndian.Uint16(body))
+			published <- [2]string{string(body[2 : 2+length]), string(body[2+length:])}
+		}
+	})
+
+	backend := &Backend{transport: b.transport("home")}
+	data, err := backend.GetAllData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thermostat, ok := data.Devices.Thermostats["t1"]
+	if !ok || len(data.Devices.Thermostats) != 1 {
+		t.Fatalf("got thermostats %+v, want t1", data.Devices.Thermostats)
+	}
+	if thermostat.Name != "Hall" || thermostat.HvacMode != nest.ModeHeat || thermostat.TargetTemperatureC != 21 {
+		t.Errorf("got thermostat %+v", thermostat)
+	}
+	if away := data.Structures[StructureId].Away; away != nest.Away {
+		t.Errorf("presence is %s, want away", away)
+	}
+
+	expect := func(want [2]string) {
+		select {
+		case got := <-published:
+			if got != want {
+				t.Errorf("published %q, want %q", got, want)
+			}
+		case <-time.After(mqttTimeout):
+			t.Fatalf("nothing published, want %q", want)
+		}
+	}
+
+	if err := backend.SetHvacMode("t1", nest.ModeCool); err != nil {
+		t.Fatal(err)
+	}
+	expect([2]string{"home/thermostats/t1/set", `{"mode":"cool"}`})
+
+	if err := backend.SetPresence(StructureId, nest.Home); err != nil {
+		t.Fatal(err)
+	}
+	expect([2]string{"home/presence/set", "home"})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/go-alfred"
+)
+
+const MaxHistory = 50
+
+// HistoryEntry records the value a field had before the workflow changed it,
+// so the change can be undone.
+type HistoryEntry struct {
+	Id     string
+	Target string
+	Name   string
+	Field  string
+	Path   string
+	Old    json.RawMessage
+	New    json.RawMessage
+	Time   time.Time
+}
+
+func (e HistoryEntry) String() string {
+	return fmt.Sprintf("%s %s: %s → %s", e.Name, e.Field, e.Old, e.New)
+}
+
+type History struct {
+	Entries []HistoryEntry
+}
+
+// cachedField returns the JSON value of a named field of a cached thermostat or
+// structure.
+func cachedField(v interface{}, field string) (json.RawMessage, bool) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, false
+	}
+
+	value, ok := fields[field]
+	return value, ok
+}
+
+// cachedValue returns the cached value of the thermostat or structure field at
+// an API path.
+func cachedValue(path string) (json.RawMessage, bool) {
+	collection, id, field := parseApiPath(path)
+	switch collection {
+	case "thermostats":
+		if t, ok := cache.AllData.Devices.Thermostats[id]; ok {
+			return cachedField(t, field)
+		}
+	case "structures":
+		if s, ok := cache.AllData.Structures[id]; ok {
+			return cachedField(s, field)
+		}
+	}
+	return nil, false
+}
+
+// fieldChange is a change to a thermostat or structure field. Target is the
+// thermostat or structure ID, and Path is the field's API path.
+type fieldChange struct {
+	Target string
+	Name   string
+	Field  string
+	Path   string
+	Value  interface{}
+}
+
+// makeChange makes a change with write, then journals it so it can be undone.
+// If the backend can't be reached, the change is queued and journaled, and
+// queued is true; if the backend rejects it, nothing is recorded. The old
+// value comes from the cache, which is refreshed first if it's stale.
+func makeChange(change fieldChange, write func(backend nest.ThermostatBackend) error) (queued bool, err error) {
+	if err := checkRefreshNow(); err != nil {
+		log.Println("Error refreshing before change:", err)
+	}
+	old, hasOld := cachedValue(change.Path)
+
+	backend, err := openBackend()
+	if err != nil {
+		return
+	}
+	err = write(backend)
+
+	if isNetworkError(err) {
+		if err = queueWrite(change.Target, change.Name, change.Field, change.Path, change.Value); err != nil {
+			return
+		}
+		queued = true
+	} else if err != nil {
+		return
+	}
+
+	if !hasOld {
+		log.Printf("No cached value for %s; can’t record change", change.Field)
+	} else if err := journalWrite(change, old); err != nil {
+		log.Println("Error recording change:", err)
+	}
+	return
+}
+
+// journalWrite records a change and the value the field had before it.
+func journalWrite(change fieldChange, old json.RawMessage) error {
+	data, err := json.Marshal(change.Value)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var history History
+	return updateJson(historyFile, &history, func() error {
+		history.Entries = append(history.Entries, HistoryEntry{
+			Id:     strconv.FormatInt(now.UnixNano(), 36),
+			Target: change.Target,
+			Name:   change.Name,
+			Field:  change.Field,
+			Path:   change.Path,
+			Old:    old,
+			New:    data,
+			Time:   now,
+		})
+		if len(history.Entries) > MaxHistory {
+			history.Entries = history.Entries[len(history.Entries)-MaxHistory:]
+		}
+		return nil
+	})
+}
+
+func loadHistory() (history History, err error) {
+	err = loadJson(historyFile, &history)
+	return
+}
+
+// undo restores the old value from a history entry and removes the entry. If
+// id is empty, the most recent entry is undone.
+func undo(id string) (entry HistoryEntry, err error) {
+	var history History
+	err = updateJson(historyFile, &history, func() error {
+		if len(history.Entries) == 0 {
+			return errors.New("Nothing to undo")
+		}
+
+		index := len(history.Entries) - 1
+		if id != "" {
+			for index >= 0 && history.Entries[index].Id != id {
+				index--
+			}
+			if index < 0 {
+				return errors.New("Unknown history entry '" + id + "'")
+			}
+		}
+
+		entry = history.Entries[index]
+		if err := writeField(OriginUndo, entry.Target, entry.Field, entry.Path, entry.Old); err != nil {
+			return err
+		}
+
+		history.Entries = append(history.Entries[:index], history.Entries[index+1:]...)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// a queued write of the undone change would otherwise be replayed over
+	// the undo; a simulated undo leaves real queued writes alone
+	if !isDryRun() {
+		if err := dropQueuedWrites(entry.Path); err != nil {
+			log.Println("Error removing undone change from queue:", err)
+		}
+	}
+	return
+}
+
+// undo --------------------------------------------------
+
+type UndoCommand struct{}
+
+func (c UndoCommand) Keyword() string {
+	return "undo"
+}
+
+func (c UndoCommand) IsEnabled() bool {
+	return isAuthorized()
+}
+
+func (c UndoCommand) MenuItem() alfred.Item {
+	return alfred.NewKeywordItem(c.Keyword(), "", " ", "Undo recent changes")
+}
+
+func (c UndoCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	history, err := loadHistory()
+	if err != nil {
+		return
+	}
+
+	if len(history.Entries) == 0 {
+		items = append(items, alfred.Item{
+			Title: tr("Nothing to undo"),
+			Valid: alfred.Invalid,
+		})
+		return
+	}
+
+	for i := len(history.Entries) - 1; i >= 0; i-- {
+		e := history.Entries[i]
+		if !alfred.FuzzyMatches(e.Name+" "+e.Field, query) {
+			continue
+		}
+
+		title := tr("Restore %s %s to %s", e.Name, e.Field, e.Old)
+		if i == len(history.Entries)-1 {
+			title = tr("Undo: %s", title)
+		}
+
+		items = append(items, alfred.Item{
+			Title:       title,
+			SubtitleAll: tr("Changed to %s at %s", e.New, formatTime(e.Time, time.Local)),
+			Arg:         "undo " + e.Id,
+		})
+	}
+
+	return
+}
+
+func (c UndoCommand) Do(query string) (string, error) {
+	entry, err := undo(query)
+	if err != nil {
+		return "", err
+	}
+
+	scheduleRefresh()
+
+	return markSimulated(tr("Restored %s %s to %s", entry.Name, entry.Field, entry.Old)), nil
+}
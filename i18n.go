@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// Displayed text goes through tr, which looks up a translation of an English
+// format string in the catalog for the display language. English strings are
+// their own translations, so a missing entry falls back to English.
+
+const DefaultLanguage = "en"
+
+var catalogs = map[string]map[string]string{
+	"de": {
+		"Select a default Nest":                          "Standard-Nest auswählen",
+		"Error communicating with Nest":                  "Fehler bei der Verbindung mit Nest",
+		"Temp: %s, Humidity: %s, Mode: %s, Presence: %s": "Temp.: %s, Luftfeuchte: %s, Modus: %s, Anwesenheit: %s",
+		"Not authorized":                                 "Nicht autorisiert",
+		"No data yet":                                    "Noch keine Daten",
+		"Error loading profile: %s":                      "Fehler beim Laden des Profils: %s",
+		"as of less than a minute ago":                   "Stand: vor weniger als einer Minute",
+		"as of 1 minute ago":                             "Stand: vor 1 Minute",
+		"as of %d minutes ago":                           "Stand: vor %d Minuten",
+		"offline":                                        "offline",
+		"Current temperature is %s":                      "Aktuelle Temperatur: %s",
+		"Heating to %s":                                  "Heizen auf %s",
+		"Cooling to %s":                                  "Kühlen auf %s",
+		"Target is %s to %s":                             "Ziel: %s bis %s",
+		"Off":                                            "Aus",
+		"Heat to %s":                                     "Auf %s heizen",
+		"Cool to %s":                                     "Auf %s kühlen",
+		"Set to %s":                                      "Auf %s setzen",
+		"Couldn’t access your default Nest":              "Kein Zugriff auf dein Standard-Nest",
+		"Online":                                         "Online",
+		"Offline":                                        "Offline",
+		"Last connected at %s":                           "Zuletzt verbunden: %s",
+		"Use the heater to maintain a minimum temperature":           "Heizung hält eine Mindesttemperatur",
+		"Use the AC to maintain a maximum temperature":               "Klimaanlage hält eine Höchsttemperatur",
+		"Use both the heater and AC to maintain a temperature range": "Heizung und Klimaanlage halten einen Temperaturbereich",
+		"Turn off heating and cooling":                               "Heizung und Kühlung ausschalten",
+		"Emergency heat":                                             "Notheizung",
+		"Emergency heat is on":                                       "Notheizung ist an",
+		"Auxiliary heat is expensive to run":                         "Zusatzheizung ist teuer im Betrieb",
+		"On for %s":                                                  "An seit %s",
+		"%s: emergency heat on for %s":                               "%s: Notheizung seit %s an",
+		"1 minute":                                                   "1 Minute",
+		"%d minutes":                                                 "%d Minuten",
+		"1 hour":                                                     "1 Stunde",
+		"%d hours":                                                   "%d Stunden",
+		"1 day":                                                      "1 Tag",
+		"%d days":                                                    "%d Tage",
+		"You’re at home":                                             "Du bist zu Hause",
+		"You’re away":                                                "Du bist unterwegs",
+		"Let Nest figure out if you’re away":                         "Nest erkennt selbst, ob du unterwegs bist",
+		"Use Celsius scale":                                          "Celsius verwenden",
+		"Use Fahrenheit scale":                                       "Fahrenheit verwenden",
+		"dry":                                                        "trocken",
+		"comfortable":                                                "angenehm",
+		"humid":                                                      "feucht",
+		"mold risk":                                                  "Schimmelgefahr",
+		"Comfort: %s, dew point %s":                                  "Klima: %s, Taupunkt %s",
+		"%s, dew point %s, heat index %s":                            "%s, Taupunkt %s, Hitzeindex %s",
+		"Temp: %s, Humidity: %s, Dew point: %s, Heat index: %s":        "Temp.: %s, Luftfeuchte: %s, Taupunkt: %s, Hitzeindex: %s",
+		"Humidity above %d%% makes rooms feel clammy":                  "Luftfeuchte über %d%% fühlt sich klamm an",
+		"Sustained humidity above %d%% or a high dew point risks mold": "Dauerhaft über %d%% Luftfeuchte oder ein hoher Taupunkt begünstigen Schimmel",
+		"Lower target 1° to reduce humidity load":                      "Ziel um 1° senken, um die Feuchtelast zu verringern",
+		"Run a dehumidifier or ventilate":                              "Luftentfeuchter benutzen oder lüften",
+		"Humidity below %d%% can irritate skin and airways":            "Luftfeuchte unter %d%% kann Haut und Atemwege reizen",
+		"Run a humidifier":                         "Luftbefeuchter benutzen",
+		"heating dries the air further":            "Heizen trocknet die Luft weiter aus",
+		"No changes needed":                        "Keine Änderungen nötig",
+		"Humidity is between %d%% and %d%%":        "Luftfeuchte liegt zwischen %d%% und %d%%",
+		"Feels like %s":                            "Gefühlt %s",
+		"Humidity makes it feel warmer than it is": "Die Luftfeuchte lässt es wärmer wirken",
+		"Outdoor: %s, %s":                          "Außen: %s, %s",
+		"Outdoor: %s":                              "Außen: %s",
+		"unknown":                                  "unbekannt",
+		"Temp: %s, Humidity: %s":                   "Temp.: %s, Luftfeuchte: %s",
+		"Set temperature to %s":                    "Temperatur auf %s gesetzt",
+		"Set mode to %s":                           "Modus auf %s gesetzt",
+		"Set presence to %s":                       "Anwesenheit auf %s gesetzt",
+		"Offline; will set temperature to %s when Nest is reachable": "Offline; Temperatur wird auf %s gesetzt, sobald Nest erreichbar ist",
+		"Offline; will set mode to %s when Nest is reachable":        "Offline; Modus wird auf %s gesetzt, sobald Nest erreichbar ist",
+		"Offline; will set presence to %s when Nest is reachable":    "Offline; Anwesenheit wird auf %s gesetzt, sobald Nest erreichbar ist",
+		"[Simulated] %s":                                              "[Simuliert] %s",
+		"Queued at %s":                                                "Vorgemerkt am %s",
+		"Sent %d changes, %d still pending":                           "%d Änderungen gesendet, %d noch ausstehend",
+		"Cleared pending changes":                                     "Ausstehende Änderungen verworfen",
+		"Changed to %s at %s":                                         "Am %[2]s auf %[1]s geändert",
+		"Restored %s %s to %s":                                        "%s %s auf %s zurückgesetzt",
+		"%s via %s, %s":                                               "%s über %s, %s",
+		"Cancelled: %s":                                               "Abgebrochen: %s",
+		"couldn’t schedule restore":                                   "Zurücksetzen konnte nicht geplant werden",
+		"restoring at %s":                                             "wird am %s zurückgesetzt",
+		" until %s":                                                   " bis %s",
+		"Then restore current settings at %s":                         "Danach am %s die aktuellen Einstellungen wiederherstellen",
+		"Select your default Nest":                                    "Standard-Nest auswählen",
+		"Select temperature scale used in this workflow":              "Temperaturskala für diesen Workflow auswählen",
+		"Set how many minutes cached data is considered fresh":        "Festlegen, wie viele Minuten zwischengespeicherte Daten aktuell bleiben",
+		"Set how many minutes of emergency heat trigger an alert":     "Festlegen, nach wie vielen Minuten Notheizung ein Alarm ausgelöst wird",
+		"Simulate changes instead of sending them to Nest":            "Änderungen simulieren, statt sie an Nest zu senden",
+		"Add or remove alternate names for your Nests":                "Alternative Namen für deine Nests hinzufügen oder entfernen",
+		"Select the language used in this workflow":                   "Sprache dieses Workflows auswählen",
+		"Set a weather station file or URL for outdoor conditions":    "Datei oder URL einer Wetterstation für Außenwerte festlegen",
+		"Use thermostats from the SDM API or an HTTP or MQTT backend": "Thermostate aus der SDM-API oder einem HTTP- oder MQTT-Backend verwenden",
+		"Add or remove URLs notified when a thermostat changes":       "URLs hinzufügen oder entfernen, die bei Thermostat-Änderungen benachrichtigt werden",
+		"Automatic (use the Nest’s locale)":                           "Automatisch (Sprache des Nest verwenden)",
+		"Simulate changes":                                            "Änderungen simulieren",
+		"Send changes to Nest":                                        "Änderungen an Nest senden",
+		"Set default Nest to '%s'":                                    "Standard-Nest auf '%s' gesetzt",
+		"Using Celsius scale":                                         "Celsius wird verwendet",
+		"Using Fahrenheit scale":                                      "Fahrenheit wird verwendet",
+		"Removed alias '%s'":                                          "Alias '%s' entfernt",
+		"Added alias '%s'":                                            "Alias '%s' hinzugefügt",
+		"Using the Nest’s language":                                   "Sprache des Nest wird verwendet",
+		"Using %s":                                                    "%s wird verwendet",
+		"Dry-run mode enabled":                                        "Probelauf aktiviert",
+		"Dry-run mode disabled":                                       "Probelauf deaktiviert",
+		"Removed weather source":                                      "Wetterquelle entfernt",
+		"Reading outdoor conditions from %s":                          "Außenwerte werden von %s gelesen",
+		"Using Nest":                                                  "Nest wird verwendet",
+		"Using thermostats from %s":                                   "Thermostate von %s werden verwendet",
+		"Removed webhook %s":                                          "Webhook %s entfernt",
+		"Added webhook %s":                                            "Webhook %s hinzugefügt",
+		"Cache TTL set to %d minutes":                                 "Cache-TTL auf %d Minuten gesetzt",
+		"Emergency heat alert time set to %d minutes":                 "Alarmzeit für Notheizung auf %d Minuten gesetzt",
+		"Press Enter to remove this alias":                            "Enter drücken, um diesen Alias zu entfernen",
+		"Type a new alias":                                            "Neuen Alias eingeben",
+		"Then choose the Nest it refers to":                           "Dann das zugehörige Nest auswählen",
+		"Use '%s' for %s":                                             "'%s' für %s verwenden",
+		"cache TTL":                                                   "Cache-TTL",
+		"emergency heat alert time":                                   "Alarmzeit für Notheizung",
+		"%s is %d minutes":                                            "%s: %d Minuten",
+		"Enter a number of minutes":                                   "Anzahl Minuten eingeben",
+		"Invalid number of minutes '%s'":                              "Ungültige Anzahl Minuten '%s'",
+		"Set %s to %d minutes":                                        "%s auf %d Minuten setzen",
+		"Currently %d minutes":                                        "Aktuell %d Minuten",
+		"No weather source":                                           "Keine Wetterquelle",
+		"Enter the path or URL of a weather station’s JSON output":    "Pfad oder URL der JSON-Ausgabe einer Wetterstation eingeben",
+		"Remove weather source":                                       "Wetterquelle entfernen",
+		"Currently %s":                                                "Aktuell %s",
+		"The URL will be read on the next refresh":                    "Die URL wird bei der nächsten Aktualisierung gelesen",
+		"Couldn’t read a weather station reading: %s":                 "Wetterstation konnte nicht gelesen werden: %s",
+		"Read outdoor conditions from %s":                             "Außenwerte von %s lesen",
+		"Enter an sdm://, http://, https://, mqtt:// or mqtts:// URL": "Eine sdm://-, http://-, https://-, mqtt://- oder mqtts://-URL eingeben",
+		"Use Nest":                "Nest verwenden",
+		"Invalid backend URL":     "Ungültige Backend-URL",
+		"Use thermostats from %s": "Thermostate von %s verwenden",
+		"The default Nest will be chosen on the next refresh": "Das Standard-Nest wird bei der nächsten Aktualisierung gewählt",
+		"Unsigned":                               "Unsigniert",
+		"Signed":                                 "Signiert",
+		"%s; press Enter to remove this webhook": "%s; Enter drücken, um diesen Webhook zu entfernen",
+		"Type a webhook URL":                     "Webhook-URL eingeben",
+		"Optionally followed by a secret to sign requests with": "Optional gefolgt von einem Secret zum Signieren der Anfragen",
+		"Invalid webhook": "Ungültiger Webhook",
+		"Enter an http:// or https:// URL, optionally followed by a secret": "Eine http://- oder https://-URL eingeben, optional gefolgt von einem Secret",
+		"Requests won’t be signed":                                          "Anfragen werden nicht signiert",
+		"Requests will be signed with the secret":                           "Anfragen werden mit dem Secret signiert",
+		"; replaces the existing webhook":                                   "; ersetzt den bestehenden Webhook",
+		"Add webhook %s":                                                    "Webhook %s hinzufügen",
+		"No pending changes":                                                "Keine ausstehenden Änderungen",
+		"Send %d pending changes now":                                       "%d ausstehende Änderungen jetzt senden",
+		"Discard all pending changes":                                       "Alle ausstehenden Änderungen verwerfen",
+		"No matching changes":                                               "Keine passenden Änderungen",
+		"Unreadable config: %s":                                             "Konfiguration nicht lesbar: %s",
+		"Authorized":                                                        "Autorisiert",
+		"Create profile '%s'":                                               "Profil '%s' anlegen",
+		"Add and switch to a new profile":                                   "Neues Profil anlegen und dorthin wechseln",
+		"Invalid profile name":                                              "Ungültiger Profilname",
+		"Use letters, numbers, '-' and '_'":                                 "Buchstaben, Ziffern, '-' und '_' verwenden",
+		"Switched to profile '%s'":                                          "Zu Profil '%s' gewechselt",
+		"Set up authorization":                                              "Autorisierung einrichten",
+		"Enter the OAuth client ID and secret for your Nest or Google developer account": "OAuth-Client-ID und -Secret deines Nest- oder Google-Entwicklerkontos eingeben",
+		"Client ID":            "Client-ID",
+		"Client secret":        "Client-Secret",
+		"Redirect URI":         "Weiterleitungs-URI",
+		"Authorization URL":    "Autorisierungs-URL",
+		"Token URL":            "Token-URL",
+		"client id":            "Client-ID",
+		"client secret":        "Client-Secret",
+		"redirect uri":         "Weiterleitungs-URI",
+		"authorization url":    "Autorisierungs-URL",
+		"token url":            "Token-URL",
+		"scope":                "Scope",
+		"config":               "Konfiguration",
+		"default":              "Standard",
+		"(none)":               "(keiner)",
+		"Step %d of %d: %s":    "Schritt %d von %d: %s",
+		"Unknown setting '%s'": "Unbekannte Einstellung '%s'",
+		"Currently %s (%s)":    "Aktuell %s (%s)",
+		"; the environment variable takes precedence": "; die Umgebungsvariable hat Vorrang",
+		"Set %s to %s":            "%s auf %s setzen",
+		"Reset %s to the default": "%s auf den Standard zurücksetzen",
+		"Saved %s":                "%s gespeichert",
+		"Reset %s":                "%s zurückgesetzt",
+		"; next, %s":              "; als Nächstes: %s",
+		"; now run authorize":     "; jetzt authorize ausführen",
+		"Nothing to undo":         "Nichts rückgängig zu machen",
+		"Restore %s %s to %s":     "%s %s auf %s zurücksetzen",
+		"Undo: %s":                "Rückgängig: %s",
+		"Copy report":             "Bericht kopieren",
+		"%d checks, %d problems":  "%d Prüfungen, %d Probleme",
+		"Describe a change":       "Änderung beschreiben",
+		"e.g. “cool bedroom 68 for 2 hours” or “away until monday”": "z. B. „cool bedroom 68 for 2 hours“ oder „away until monday“",
+		"Try something like “heat upstairs to 70 until 6pm”":        "Versuche etwas wie „heat upstairs to 70 until 6pm“",
+		"Press Enter to apply":    "Enter drücken zum Anwenden",
+		"Presence at %s: %s → %s": "Anwesenheit in %s: %s → %s",
+		"Mode: %s → %s":           "Modus: %s → %s",
+		"High target":             "Oberes Ziel",
+		"Low target":              "Unteres Ziel",
+		"Target":                  "Ziel",
+		"Restore %s":              "Wiederherstellen: %s",
+		"Set a shell command to run for each alert":  "Shell-Befehl festlegen, der bei jedem Alarm ausgeführt wird",
+		"Removed alert command":                      "Alarmbefehl entfernt",
+		"Running '%s' for each alert":                "'%s' wird bei jedem Alarm ausgeführt",
+		"No alert command":                           "Kein Alarmbefehl",
+		"Enter a shell command; the alert is in $%s": "Shell-Befehl eingeben; der Alarm steht in $%s",
+		"Remove alert command":                       "Alarmbefehl entfernen",
+		"Run '%s' for each alert":                    "'%s' bei jedem Alarm ausführen",
+		"The alert is in $%s":                        "Der Alarm steht in $%s",
+	},
+}
+
+// languageNames lists the languages with catalogs, for the config command.
+var languageNames = map[string]string{
+	"en": "English",
+	"de": "Deutsch",
+}
+
+// displayLanguage returns the language to display text in: the configured
+// language if there is one, otherwise the language of the default Nest's
+// locale.
+func displayLanguage() string {
+	if config.Language != "" {
+		return config.Language
+	}
+	if t, ok := cache.AllData.Devices.Thermostats[config.NestId]; ok && t.Locale != "" {
+		lang := strings.ToLower(strings.SplitN(strings.Replace(t.Locale, "_", "-", -1), "-", 2)[0])
+		if _, ok := languageNames[lang]; ok {
+			return lang
+		}
+	}
+	return DefaultLanguage
+}
+
+// tr translates a format string into the display language and formats it.
+func tr(format string, args ...interface{}) string {
+	if catalog, ok := catalogs[displayLanguage()]; ok {
+		if translated, ok := catalog[format]; ok {
+			format = translated
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// decimalSeparator returns the decimal separator for the display language.
+func decimalSeparator() string {
+	switch displayLanguage() {
+	case "de":
+		return ","
+	}
+	return "."
+}
+
+func formatNumber(value float64) string {
+	return strings.Replace(strconv.FormatFloat(value, 'f', -1, 64), ".", decimalSeparator(), 1)
+}
+
+// formatTemp formats a temperature for display.
+func formatTemp(t nest.Temperature) string {
+	return formatNumber(t.Value()) + "°" + string(t.Scale())
+}
+
+// formatHumidity formats a humidity for display.
+func formatHumidity(h nest.Humidity) string {
+	return formatNumber(float64(h)) + "%"
+}
+
+// structureLocation returns the time zone of a structure, or the local time
+// zone if the structure's is unknown.
+func structureLocation(structureId string) *time.Location {
+	if s, ok := cache.AllData.Structures[structureId]; ok && s.TimeZone != "" {
+		if loc, err := time.LoadLocation(s.TimeZone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// thermostatLocation returns the time zone of the structure a thermostat is
+// in, or the local time zone if it's unknown.
+func thermostatLocation(deviceId string) *time.Location {
+	return structureLocation(cache.AllData.Devices.Thermostats[deviceId].StructureId)
+}
+
+// formatTime formats a time in a given time zone using the display language's
+// conventions.
+func formatTime(t time.Time, loc *time.Location) string {
+	switch displayLanguage() {
+	case "de":
+		return t.In(loc).Format("02.01.2006 15:04 MST")
+	}
+	return t.In(loc).Format("Jan 2, 2006 3:04pm MST")
+}
+
+// formatShortTime formats a time in the near future, omitting the year and
+// time zone.
+func formatShortTime(t time.Time, loc *time.Location) string {
+	switch displayLanguage() {
+	case "de":
+		return t.In(loc).Format("02.01. 15:04")
+	}
+	return t.In(loc).Format("Mon Jan 2 3:04pm")
+}
@@ -0,0 +1,50 @@
+package main
+
+import "github.com/jason0x43/alfred-nest/nest"
+
+// Item icons, relative to the workflow directory
+const (
+	IconHeat     = "icons/heat.png"
+	IconCool     = "icons/cool.png"
+	IconHeatCool = "icons/heat-cool.png"
+	IconOff      = "icons/off.png"
+	IconLeaf     = "icons/leaf.png"
+	IconOffline  = "icons/offline.png"
+	IconAway     = "icons/away.png"
+)
+
+// modeIcon returns the icon for an HVAC mode.
+func modeIcon(mode nest.HvacMode) string {
+	switch mode {
+	case nest.ModeHeat:
+		return IconHeat
+	case nest.ModeCool:
+		return IconCool
+	case nest.ModeRange:
+		return IconHeatCool
+	}
+	return IconOff
+}
+
+// presenceIcon returns the icon for a presence state, or none for home.
+func presenceIcon(presence nest.Presence) string {
+	if presence == nest.Away || presence == nest.AutoAway {
+		return IconAway
+	}
+	return ""
+}
+
+// thermostatIcon returns an icon summarizing a thermostat's state. Being
+// offline takes precedence over the structure being away, which takes
+// precedence over the leaf, which takes precedence over the HVAC mode.
+func thermostatIcon(thermostat *nest.Thermostat, structure *nest.Structure) string {
+	switch {
+	case !thermostat.IsOnline:
+		return IconOffline
+	case structure != nil && (structure.Away == nest.Away || structure.Away == nest.AutoAway):
+		return IconAway
+	case thermostat.HasLeaf:
+		return IconLeaf
+	}
+	return modeIcon(thermostat.HvacMode)
+}
@@ -0,0 +1,248 @@
+// Package sdmfake is an in-memory stand-in for the Smart Device Management
+// API, for testing the sdm package and trying the SDM backend offline.
+package sdmfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/sdm"
+)
+
+// Server is a stand-in for the SDM API that keeps its devices in memory, so
+// the backend can be tried without a Device Access project. If Token is set,
+// requests must carry it as a bearer token; otherwise any token, or none, is
+// accepted.
+type Server struct {
+	Token string
+
+	lock       sync.Mutex
+	project    string
+	devices    []*sdm.Device
+	structures []sdm.Structure
+}
+
+// NewServer returns a server for a project with one structure and one
+// thermostat.
+func NewServer(project string) *Server {
+	enterprise := "enterprises/" + project
+	structure := enterprise + "/structures/home"
+
+	device := &sdm.Device{
+		Name:   enterprise + "/devices/living-room",
+		Type:   sdm.TypeThermostat,
+		Traits: map[string]json.RawMessage{},
+	}
+	device.ParentRelations = append(device.ParentRelations, struct {
+		Parent      string `json:"parent"`
+		DisplayName string `json:"displayName"`
+	}{structure + "/rooms/living-room", "Living Room"})
+
+	setTrait(device, sdm.TraitInfo, sdm.InfoTrait{})
+	setTrait(device, sdm.TraitConnectivity, sdm.ConnectivityTrait{Status: "ONLINE"})
+	setTrait(device, sdm.TraitHumidity, sdm.HumidityTrait{AmbientHumidityPercent: 42})
+	setTrait(device, sdm.TraitTemperature, sdm.TemperatureTrait{AmbientTemperatureCelsius: 20.5})
+	setTrait(device, sdm.TraitSettings, sdm.SettingsTrait{TemperatureScale: "CELSIUS"})
+	setTrait(device, sdm.TraitFan, sdm.FanTrait{TimerMode: "OFF"})
+	setTrait(device, sdm.TraitMode, sdm.ModeTrait{Mode: "HEAT",
+		AvailableModes: []string{"HEAT", "COOL", "HEATCOOL", "OFF"}})
+	setTrait(device, sdm.TraitEco, sdm.EcoTrait{Mode: "OFF", HeatCelsius: 15.5, CoolCelsius: 26})
+	setTrait(device, sdm.TraitHvac, sdm.HvacTrait{Status: "HEATING"})
+	setTrait(device, sdm.TraitSetpoint, sdm.SetpointTrait{HeatCelsius: 21})
+
+	home := sdm.Structure{Name: structure, Traits: map[string]json.RawMessage{}}
+	home.Traits[sdm.TraitStructureInfo], _ = json.Marshal(sdm.InfoTrait{CustomName: "Home"})
+
+	return &Server{
+		project:    project,
+		devices:    []*sdm.Device{device},
+		structures: []sdm.Structure{home},
+	}
+}
+
+func setTrait(d *sdm.Device, name string, v interface{}) {
+	d.Traits[name], _ = json.Marshal(v)
+}
+
+// fakeError is an error in the format the SDM API returns.
+type fakeError struct {
+	code   int
+	status string
+	msg    string
+}
+
+func (f *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	result, ferr := f.handle(r)
+	w.Header().Set("Content-Type", "application/json")
+	if ferr != nil {
+		w.WriteHeader(ferr.code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{"code": ferr.code, "message": ferr.msg, "status": ferr.status},
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (f *Server) handle(r *http.Request) (interface{}, *fakeError) {
+	if f.Token != "" && r.Header.Get("Authorization") != "Bearer "+f.Token {
+		return nil, &fakeError{http.StatusUnauthorized, "UNAUTHENTICATED", "Invalid access token"}
+	}
+
+	prefix := "/enterprises/" + f.project + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return nil, &fakeError{http.StatusNotFound, "NOT_FOUND", "Unknown enterprise"}
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+
+	switch {
+	case path == "structures" && r.Method == "GET":
+		return map[string]interface{}{"structures": f.structures}, nil
+
+	case path == "devices" && r.Method == "GET":
+		return map[string]interface{}{"devices": f.devices}, nil
+
+	case strings.HasPrefix(path, "devices/"):
+		id := strings.TrimPrefix(path, "devices/")
+		command := strings.HasSuffix(id, ":executeCommand")
+		id = strings.TrimSuffix(id, ":executeCommand")
+
+		var device *sdm.Device
+		for _, d := range f.devices {
+			if d.Id() == id {
+				device = d
+			}
+		}
+		if device == nil {
+			return nil, &fakeError{http.StatusNotFound, "NOT_FOUND", "Device " + id + " not found"}
+		}
+
+		if !command && r.Method == "GET" {
+			return device, nil
+		}
+		if command && r.Method == "POST" {
+			var body struct {
+				Command string          `json:"command"`
+				Params  json.RawMessage `json:"params"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				return nil, &fakeError{http.StatusBadRequest, "INVALID_ARGUMENT", err.Error()}
+			}
+			if ferr := execute(device, body.Command, body.Params); ferr != nil {
+				return nil, ferr
+			}
+			return struct{}{}, nil
+		}
+	}
+
+	return nil, &fakeError{http.StatusNotFound, "NOT_FOUND", "Unknown path " + r.URL.Path}
+}
+
+// execute applies a command to a device, with the checks the SDM API makes.
+func execute(d *sdm.Device, command string, params json.RawMessage) *fakeError {
+	invalid := func(format string, args ...interface{}) *fakeError {
+		return &fakeError{http.StatusBadRequest, "FAILED_PRECONDITION", fmt.Sprintf(format, args...)}
+	}
+
+	var mode sdm.ModeTrait
+	var setpoint sdm.SetpointTrait
+	d.Trait(sdm.TraitMode, &mode)
+	d.Trait(sdm.TraitSetpoint, &setpoint)
+
+	var p struct {
+		HeatCelsius *float64 `json:"heatCelsius"`
+		CoolCelsius *float64 `json:"coolCelsius"`
+		Mode        string   `json:"mode"`
+		TimerMode   string   `json:"timerMode"`
+		Duration    string   `json:"duration"`
+	}
+	if err := json.Unmarshal(params, &p); err != nil {
+		return &fakeError{http.StatusBadRequest, "INVALID_ARGUMENT", err.Error()}
+	}
+
+	switch command {
+	case sdm.CommandSetHeat:
+		if mode.Mode != "HEAT" || p.HeatCelsius == nil {
+			return invalid("SetHeat requires HEAT mode and heatCelsius")
+		}
+		setpoint = sdm.SetpointTrait{HeatCelsius: *p.HeatCelsius}
+
+	case sdm.CommandSetCool:
+		if mode.Mode != "COOL" || p.CoolCelsius == nil {
+			return invalid("SetCool requires COOL mode and coolCelsius")
+		}
+		setpoint = sdm.SetpointTrait{CoolCelsius: *p.CoolCelsius}
+
+	case sdm.CommandSetRange:
+		if mode.Mode != "HEATCOOL" || p.HeatCelsius == nil || p.CoolCelsius == nil {
+			return invalid("SetRange requires HEATCOOL mode, heatCelsius and coolCelsius")
+		}
+		if *p.CoolCelsius-*p.HeatCelsius < 1.5 {
+			return invalid("Cool setpoint must be at least 1.5° above heat setpoint")
+		}
+		setpoint = sdm.SetpointTrait{HeatCelsius: *p.HeatCelsius, CoolCelsius: *p.CoolCelsius}
+
+	case sdm.CommandSetMode:
+		available := false
+		for _, m := range mode.AvailableModes {
+			available = available || m == p.Mode
+		}
+		if !available {
+			return invalid("Mode %s isn't available", p.Mode)
+		}
+
+		// keep a setpoint for the new mode, as the thermostat would
+		switch p.Mode {
+		case "HEAT":
+			setpoint = sdm.SetpointTrait{HeatCelsius: setpoint.HeatCelsius}
+			if setpoint.HeatCelsius == 0 {
+				setpoint.HeatCelsius = 20
+			}
+		case "COOL":
+			setpoint = sdm.SetpointTrait{CoolCelsius: setpoint.CoolCelsius}
+			if setpoint.CoolCelsius == 0 {
+				setpoint.CoolCelsius = 24
+			}
+		case "HEATCOOL":
+			if setpoint.HeatCelsius == 0 {
+				setpoint.HeatCelsius = 20
+			}
+			if setpoint.CoolCelsius < setpoint.HeatCelsius+1.5 {
+				setpoint.CoolCelsius = setpoint.HeatCelsius + 4
+			}
+		case "OFF":
+			setpoint = sdm.SetpointTrait{}
+		}
+		mode.Mode = p.Mode
+
+	case sdm.CommandSetTimer:
+		fan := sdm.FanTrait{TimerMode: p.TimerMode}
+		switch p.TimerMode {
+		case "ON":
+			duration, err := time.ParseDuration(p.Duration)
+			if err != nil {
+				duration = sdm.FanTimerDuration
+			}
+			fan.TimerTimeout = time.Now().Add(duration).UTC()
+		case "OFF":
+		default:
+			return invalid("Invalid timerMode %q", p.TimerMode)
+		}
+		setTrait(d, sdm.TraitFan, fan)
+		return nil
+
+	default:
+		return &fakeError{http.StatusBadRequest, "INVALID_ARGUMENT", "Unknown command " + command}
+	}
+
+	setTrait(d, sdm.TraitMode, mode)
+	setTrait(d, sdm.TraitSetpoint, setpoint)
+	return nil
+}
@@ -1,38 +1,98 @@
 package main
 
 import (
+	"encoding/json"
 	"log"
 	"path"
 	"time"
 
+	"github.com/jason0x43/alfred-nest/nest"
 	"github.com/jason0x43/go-alfred"
 )
 
 type Config struct {
+	Version      int
 	NestId       string
 	AccessToken  string
 	AccessExpiry time.Time
-	Scale        TempScale
+	RefreshToken string `json:",omitempty"`
+	Scale        nest.TempScale
+	ApiToken     string            `json:",omitempty"`
+	Webhooks     []Webhook         `json:",omitempty"`
+	CacheTtl     int               `json:",omitempty"`
+	DryRun       bool              `json:",omitempty"`
+	Aliases      map[string]string `json:",omitempty"`
+	Language     string            `json:",omitempty"`
+
+	EmergencyHeatMinutes int    `json:",omitempty"`
+	AlertCommand         string `json:",omitempty"`
+	WeatherSource        string `json:",omitempty"`
+	BackendUrl           string `json:",omitempty"`
+
+	// OAuth client and endpoints, overriding the defaults
+	ClientId     string `json:",omitempty"`
+	ClientSecret string `json:",omitempty"`
+	RedirectUri  string `json:",omitempty"`
+	AuthUrl      string `json:",omitempty"`
+	TokenUrl     string `json:",omitempty"`
+	OauthScope   string `json:",omitempty"`
 }
 
 type Cache struct {
-	Time    time.Time
-	AllData AllData
+	Version        int
+	Time           time.Time
+	AllData        nest.AllData
+	Expired        bool                       `json:",omitempty"`
+	LastError      string                     `json:",omitempty"`
+	RefreshStarted time.Time                  `json:",omitempty"`
+	Simulated      map[string]json.RawMessage `json:",omitempty"`
+	EmergencyHeat  map[string]EmergencyHeat   `json:",omitempty"`
+	Weather        *Weather                   `json:",omitempty"`
 }
 
 const (
-	ClientId     = "359f0dd0-8935-4390-9f10-863a5b7ec606"
-	CallbackPath = "/oauth/callback"
-	CallbackPort = "2222"
-	RedirectUri  = "http://localhost:" + CallbackPort + CallbackPath
+	DefaultClientId    = "359f0dd0-8935-4390-9f10-863a5b7ec606"
+	CallbackPath       = "/oauth/callback"
+	CallbackPort       = "2222"
+	DefaultRedirectUri = "http://localhost:" + CallbackPort + CallbackPath
+	DefaultAuthUrl     = "https://home.nest.com/login/oauth2"
+	DefaultTokenUrl    = "https://api.home.nest.com/oauth2/access_token"
+
+	// ClientVersion is the version of the Nest product DefaultClientId was last
+	// published as. Tokens authorized for an older version lack any
+	// permissions added since.
+	ClientVersion = 1
+
+	// DefaultCacheTtl is the default number of minutes cached data is
+	// considered fresh
+	DefaultCacheTtl = 5
+	// OfflineMarker prefixes items showing data from a failed refresh
+	OfflineMarker = "⊘"
+	// WarningMarker prefixes items that need the user's attention
+	WarningMarker = "⚠"
+
+	backgroundRefreshTimeout = 30 * time.Second
 )
 
+// The client secret is optional. Authorization uses PKCE, so builds without
+// NEST_CLIENT_SECRET can authorize with OAuth servers that allow it.
 //go:generate go build support/oauthgen.go
 //go:generate ./oauthgen credentials.go
 
+// ClientSecret is the built-in client secret, set by credentials.go
 var ClientSecret string
 var cacheFile string
 var configFile string
+var queueFile string
+var historyFile string
+var auditFile string
+var scheduleFile string
+var samplesFile string
+var authFile string
+
+// writeOrigin is recorded in the audit log as the origin of this process's
+// writes
+var writeOrigin string
 var config Config
 var cache Cache
 
@@ -43,23 +103,41 @@ func main() {
 		log.Fatalln("Error opening workflow:", err)
 	}
 
-	configFile = path.Join(workflow.DataDir(), "config.json")
+	dataDir = workflow.DataDir()
+	cacheDir = workflow.CacheDir()
+	profilesFile = path.Join(dataDir, "profiles.json")
+
+	if err = useProfile(activeProfile()); err != nil {
+		log.Println("Error selecting profile:", err)
+		if err = useProfile(DefaultProfile); err != nil {
+			log.Fatalln("Error selecting default profile:", err)
+		}
+	}
+
+	log.Println("Using profile", profile)
 	log.Println("Using config file", configFile)
-	err = alfred.LoadJson(configFile, &config)
+	err = loadJson(configFile, &config)
 	if err != nil {
 		log.Println("Error loading config:", err)
 	}
 
-	if config.Scale == "" {
-		config.Scale = ScaleF
-		if err = alfred.SaveJson(configFile, &config); err != nil {
+	if config.Scale == "" || config.Version != ConfigVersion {
+		// save the default scale and any migrations
+		err = updateConfig(func(c *Config) error {
+			if c.Scale == "" {
+				c.Scale = nest.ScaleF
+			}
+			return nil
+		})
+		if err != nil {
 			log.Println("Error updating config:", err)
 		}
 	}
 
-	cacheFile = path.Join(workflow.CacheDir(), "cache.json")
+	writeOrigin = detectOrigin()
+
 	log.Println("Using cache file", cacheFile)
-	if err = alfred.LoadJson(cacheFile, &cache); err != nil {
+	if err = loadJson(cacheFile, &cache); err != nil {
 		log.Println("Error loading cache:", err)
 	}
 
@@ -73,6 +151,18 @@ func main() {
 		ConfigCommand{},
 		AuthorizeCommand{},
 		AuthServerCommand{},
+		ExporterCommand{},
+		ApiCommand{},
+		WebhookCommand{},
+		QueueCommand{},
+		UndoCommand{},
+		LogCommand{},
+		ProfileCommand{},
+		SayCommand{},
+		ScheduleCommand{},
+		ComfortCommand{},
+		DoctorCommand{},
+		SetupCommand{},
 	}
 
 	workflow.Run(commands)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricLabels is a set of Prometheus label name/value pairs.
+type metricLabels map[string]string
+
+// String renders a label set in Prometheus text exposition format, with
+// label names sorted so output is stable between scrapes.
+func (l metricLabels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	var names []string
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(l[name])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+// counterVec is a monotonically increasing counter partitioned by a single
+// label.
+type counterVec struct {
+	lock   sync.Mutex
+	label  string
+	counts map[string]uint64
+}
+
+func newCounterVec(label string) *counterVec {
+	return &counterVec{label: label, counts: map[string]uint64{}}
+}
+
+// Inc increments the counter for a given label value.
+func (c *counterVec) Inc(value string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[value]++
+}
+
+// write writes every series in this counter to w.
+func (c *counterVec) write(w io.Writer, name, help string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+	var values []string
+	for value := range c.counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		fmt.Fprintf(w, "%s%s %d\n", name, metricLabels{c.label: value}, c.counts[value])
+	}
+}
+
+// apiCalls and apiErrors count the requests made to the thermostat backend,
+// keyed by HTTP method, or by SUBSCRIBE and PUBLISH for MQTT backends.
+var apiCalls = newCounterVec("method")
+var apiErrors = newCounterVec("method")
+
+// countRequest counts a request to the thermostat backend. Backends call it
+// for each request they make.
+func countRequest(method string, err error) {
+	apiCalls.Inc(method)
+	if err != nil {
+		apiErrors.Inc(method)
+	}
+}
+
+// gaugeWriter writes gauge families, emitting the HELP and TYPE header the
+// first time each family is seen.
+type gaugeWriter struct {
+	w    io.Writer
+	seen map[string]bool
+}
+
+func newGaugeWriter(w io.Writer) *gaugeWriter {
+	return &gaugeWriter{w: w, seen: map[string]bool{}}
+}
+
+func (g *gaugeWriter) write(name, help string, labels metricLabels, value float64) {
+	if !g.seen[name] {
+		fmt.Fprintf(g.w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(g.w, "# TYPE %s gauge\n", name)
+		g.seen[name] = true
+	}
+	fmt.Fprintf(g.w, "%s%s %v\n", name, labels, value)
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
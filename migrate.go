@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// The config and cache files carry a Version field. When a file written by an
+// older version of the workflow is loaded, it's decoded into a generic
+// document and passed through each migration between its version and the
+// current one before being decoded into the current struct. Migration i
+// upgrades a document from version i to version i+1, so the current version
+// is the number of migrations.
+//
+// Files written by a newer version of the workflow aren't read at all, since
+// saving them again would drop whatever the newer version added.
+
+var (
+	ConfigVersion = len(configMigrations)
+	CacheVersion  = len(cacheMigrations)
+)
+
+type jsonDoc map[string]interface{}
+
+type migration func(doc jsonDoc) error
+
+var configMigrations = []migration{
+	// 0 -> 1: unversioned config; fill in the default scale so older files
+	// don't depend on main to do it
+	func(doc jsonDoc) error {
+		if scale, _ := doc["Scale"].(string); scale == "" {
+			doc["Scale"] = string(nest.ScaleF)
+		}
+		return nil
+	},
+}
+
+var cacheMigrations = []migration{
+	// 0 -> 1: unversioned cache; expire it so it's refreshed right away
+	func(doc jsonDoc) error {
+		doc["Expired"] = true
+		return nil
+	},
+}
+
+// migrationsFor returns the migrations for a versioned file type, or nil if
+// v isn't versioned.
+func migrationsFor(v interface{}) []migration {
+	switch v.(type) {
+	case *Config:
+		return configMigrations
+	case *Cache:
+		return cacheMigrations
+	}
+	return nil
+}
+
+// decodeVersioned decodes data into v, first upgrading it with the given
+// migrations if it was written by an older version.
+func decodeVersioned(data []byte, v interface{}, migrations []migration) error {
+	var doc jsonDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	version := 0
+	if n, ok := doc["Version"].(float64); ok {
+		version = int(n)
+	}
+
+	if version > len(migrations) {
+		return newerVersionError{version, len(migrations)}
+	}
+
+	for ; version < len(migrations); version++ {
+		log.Printf("Migrating from version %d to %d", version, version+1)
+		if err := migrations[version](doc); err != nil {
+			return fmt.Errorf("migrating from version %d: %s", version, err)
+		}
+		doc["Version"] = version + 1
+	}
+
+	if data, err := json.Marshal(doc); err != nil {
+		return err
+	} else {
+		return json.Unmarshal(data, v)
+	}
+}
+
+// newerVersionError is returned when a file was written by a newer version of
+// the workflow.
+type newerVersionError struct {
+	version   int
+	supported int
+}
+
+func (e newerVersionError) Error() string {
+	return fmt.Sprintf("file version %d is newer than supported version %d; update the workflow",
+		e.version, e.supported)
+}
+
+// backupFile moves an unreadable file aside so it can be inspected later, and
+// returns the backup's path.
+func backupFile(path string) (string, error) {
+	backup := path + ".bak-" + time.Now().Format("20060102-150405")
+	return backup, os.Rename(path, backup)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+func TestDecodeVersionedConfig(t *testing.T) {
+	tests := []struct {
+		data  string
+		scale nest.TempScale
+		nest  string
+	}{
+		{`{"NestId":"t1"}`, nest.ScaleF, "t1"},
+		{`{"Scale":"","NestId":"t1"}`, nest.ScaleF, "t1"},
+		{`{"Scale":"C"}`, nest.ScaleC, ""},
+		{`{"Version":0,"Scale":"C"}`, nest.ScaleC, ""},
+	}
+
+	for _, test := range tests {
+		var c Config
+		if err := decodeVersioned([]byte(test.data), &c, configMigrations); err != nil {
+			t.Errorf("%s: %s", test.data, err)
+			continue
+		}
+		if c.Version != ConfigVersion || c.Scale != test.scale || c.NestId != test.nest {
+			t.Errorf("%s: got version %d, scale %s, nest %q; want %d, %s, %q", test.data, c.Version,
+				c.Scale, c.NestId, ConfigVersion, test.scale, test.nest)
+		}
+	}
+}
+
+func TestDecodeVersionedCache(t *testing.T) {
+	tests := []struct {
+		data    string
+		expired bool
+	}{
+		// unversioned caches are expired so they're refreshed
+		{`{"Time":"2026-01-02T03:04:05Z"}`, true},
+		// current ones are left alone
+		{`{"Version":1,"Time":"2026-01-02T03:04:05Z"}`, false},
+	}
+
+	for _, test := range tests {
+		var c Cache
+		if err := decodeVersioned([]byte(test.data), &c, cacheMigrations); err != nil {
+			t.Errorf("%s: %s", test.data, err)
+			continue
+		}
+		if c.Version != CacheVersion || c.Expired != test.expired || c.Time.Year() != 2026 {
+			t.Errorf("%s: got version %d, expired %v, time %s", test.data, c.Version, c.Expired, c.Time)
+		}
+	}
+}
+
+func TestDecodeVersionedSteps(t *testing.T) {
+	var steps []string
+	step := func(name string) migration {
+		return func(doc jsonDoc) error {
+			steps = append(steps, name)
+			doc[name] = true
+			return nil
+		}
+	}
+	migrations := []migration{step("A"), step("B"), step("C")}
+
+	var doc jsonDoc
+	if err := decodeVersioned([]byte(`{"Version":1}`), &doc, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(steps, "") != "BC" {
+		t.Errorf("ran migrations %v, want B and C", steps)
+	}
+	if doc["Version"] != float64(3) || doc["A"] != nil || doc["C"] != true {
+		t.Errorf("got %v", doc)
+	}
+}
+
+func TestDecodeVersionedErrors(t *testing.T) {
+	failing := []migration{func(doc jsonDoc) error { return errors.New("bad") }}
+
+	var doc jsonDoc
+	err := decodeVersioned([]byte(`{"Version":2}`), &doc, failing)
+	if e, ok := err.(newerVersionError); !ok || e.version != 2 || e.supported != 1 {
+		t.Errorf("newer version returned %v, want newerVersionError", err)
+	}
+
+	if err := decodeVersioned([]byte(`{}`), &doc, failing); err == nil ||
+		err.Error() != "migrating from version 0: bad" {
+		t.Errorf("failed migration returned %v", err)
+	}
+
+	if err := decodeVersioned([]byte(`{`), &doc, failing); err == nil {
+		t.Error("invalid JSON was decoded")
+	}
+}
+
+// TestLoadNewerVersion checks that a file from a newer version of the workflow
+// is refused and left in place.
+func TestLoadNewerVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	data := []byte(`{"Version":99,"NestId":"t1"}`)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var c Config
+	if err := loadJson(path, &c); err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Errorf("loadJson returned %v, want a newer version error", err)
+	}
+	if saved, err := ioutil.ReadFile(path); err != nil || string(saved) != string(data) {
+		t.Errorf("file was changed: %q, %v", saved, err)
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
-import "github.com/jason0x43/go-alfred"
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/go-alfred"
+)
 
 type ModeCommand struct{}
 
@@ -23,5 +29,44 @@ func (t ModeCommand) MenuItem() alfred.Item {
 
 func (t ModeCommand) Items(prefix, query string) (items []alfred.Item, err error) {
 	thermostat, _ := cache.AllData.Devices.Thermostats[config.NestId]
-	return getModeItems(prefix, query, thermostat.HvacMode), nil
+	return getModeItems(prefix, query, thermostat.DeviceId, thermostat.HvacMode), nil
+}
+
+func (t ModeCommand) Do(query string) (out string, err error) {
+	var msg modeMessage
+	if err = json.Unmarshal([]byte(query), &msg); err != nil {
+		return
+	}
+
+	thermostat, ok := cache.AllData.Devices.Thermostats[msg.DeviceId]
+	if !ok {
+		return out, errors.New("Unknown thermostat '" + msg.DeviceId + "'")
+	}
+
+	change := fieldChange{
+		Target: msg.DeviceId,
+		Name:   thermostat.Name,
+		Field:  "hvac_mode",
+		Path:   nest.ThermostatPath(msg.DeviceId, "hvac_mode"),
+		Value:  msg.Mode,
+	}
+
+	queued, err := makeChange(change, func(backend nest.ThermostatBackend) error {
+		return backend.SetHvacMode(msg.DeviceId, msg.Mode)
+	})
+	if err != nil {
+		return
+	}
+	if queued {
+		return tr("Offline; will set mode to %s when Nest is reachable", msg.Mode), nil
+	}
+
+	scheduleRefresh()
+
+	return markSimulated(tr("Set mode to %s", msg.Mode)), err
+}
+
+type modeMessage struct {
+	DeviceId string
+	Mode     nest.HvacMode
 }
@@ -0,0 +1,32 @@
+package nest
+
+// ThermostatBackend is a source of thermostats that can be read and
+// controlled. Session implements it for the Nest API; other thermostats can be
+// supported by implementing it too.
+type ThermostatBackend interface {
+	// GetAllData returns the current state of every thermostat and the
+	// structures they're in.
+	GetAllData() (AllData, error)
+
+	// GetThermostats lists the backend's thermostats.
+	GetThermostats() ([]Thermostat, error)
+
+	// SetTargetTemp sets a thermostat's target temperature, or in heat-cool
+	// mode the target selected by hilo. It returns the temperature that was
+	// set.
+	SetTargetTemp(id string, temp Temperature, hilo HighLow) (Temperature, error)
+
+	// SetTargetRange sets both targets used in heat-cool mode.
+	SetTargetRange(id string, low, high Temperature) error
+
+	// SetHvacMode sets a thermostat's heating and cooling mode.
+	SetHvacMode(id string, mode HvacMode) error
+
+	// SetPresence sets whether anyone is home at a structure.
+	SetPresence(structureId string, presence Presence) error
+
+	// SetFanTimer turns a thermostat's fan timer on or off.
+	SetFanTimer(id string, on bool) error
+}
+
+var _ ThermostatBackend = &Session{}
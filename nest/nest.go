@@ -1,39 +1,51 @@
-package main
+// Package nest is a client for the Nest REST API. It reads the data a token
+// has access to and changes thermostat and structure settings.
+package nest
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"net/url"
-	"strconv"
 	"strings"
 	"time"
-
-	"github.com/jason0x43/go-log"
 )
 
+// Presence is whether anyone is home at a structure.
+type Presence string
+
+// HvacMode is the heating and cooling mode of a thermostat.
+type HvacMode string
+
+// HVAC modes and presence states
 const (
-	ApiHost = "https://developer-api.nest.com"
+	ModeHeat  = HvacMode("heat")
+	ModeCool  = HvacMode("cool")
+	ModeRange = HvacMode("heat-cool")
+	ModeOff   = HvacMode("off")
+	Away      = Presence("away")
+	Home      = Presence("home")
+	AutoAway  = Presence("auto-away")
 )
 
+// AllData is the complete tree of data a token can read, as returned for
+// the API root.
 type AllData struct {
 	Metadata   Metadata             `json:"metadata"`
 	Devices    Devices              `json:"devices"`
 	Structures map[string]Structure `json:"structures"`
 }
 
+// Metadata describes the token and the client it was issued to.
 type Metadata struct {
 	AccessToken   string `json:"access_token"`
 	ClientVersion int64  `json:"client_version"`
 }
 
+// Devices holds the devices in AllData, keyed by device ID.
 type Devices struct {
 	Thermostats map[string]Thermostat `json:"thermostats"`
 }
 
+// Thermostat is the state of a Nest thermostat. Temperatures are reported in
+// both scales; use the accessor methods to pick one.
 type Thermostat struct {
 	DeviceId               string    `json:"device_id"`
 	Locale                 string    `json:"locale"`
@@ -67,6 +79,7 @@ type Thermostat struct {
 	Humidity               Humidity  `json:"humidity"`
 }
 
+// Structure is a home containing one or more thermostats.
 type Structure struct {
 	StructureId         string    `json:"structure_id"`
 	Thermostats         []string  `json:"thermostats"`
@@ -82,158 +95,7 @@ type Structure struct {
 	} `json:"eta"`
 }
 
-type Session struct {
-	token string
-}
-
-type Presence string
-type TempF float64
-type TempC float64
-type Humidity float64
-type TempScale string
-type HighLow string
-type HvacMode string
-
-const (
-	ScaleC    = TempScale("C")
-	ScaleF    = TempScale("F")
-	TypeHigh  = HighLow("high")
-	TypeLow   = HighLow("low")
-	ModeHeat  = HvacMode("heat")
-	ModeCool  = HvacMode("cool")
-	ModeRange = HvacMode("heat-cool")
-	ModeOff   = HvacMode("off")
-	Away      = Presence("away")
-	Home      = Presence("home")
-	AutoAway  = Presence("auto-away")
-)
-
-type Temperature interface {
-	Value() float64
-	Scale() TempScale
-	String() string
-}
-
-func NewTemp(value float64, scale TempScale) Temperature {
-	if scale == ScaleF {
-		return TempF(value)
-	} else {
-		return TempC(value)
-	}
-}
-
-func (t TempF) Value() float64 {
-	return float64(t)
-}
-
-func (t TempF) Scale() TempScale {
-	return ScaleF
-}
-
-func (t TempF) String() string {
-	return strconv.FormatFloat(float64(t), 'f', -1, 64) + "°F"
-}
-
-func (t TempC) Value() float64 {
-	return float64(t)
-}
-
-func (t TempC) Scale() TempScale {
-	return ScaleC
-}
-
-func (t TempC) String() string {
-	return strconv.FormatFloat(float64(t), 'f', -1, 64) + "°C"
-}
-
-func (h Humidity) String() string {
-	return strconv.FormatFloat(float64(h), 'f', -1, 64) + "%"
-}
-
-func OpenSession(token string) Session {
-	return Session{token: token}
-}
-
-func (session *Session) GetAllData() (allData AllData, err error) {
-	data, err := session.get("/")
-	if err != nil {
-		return
-	}
-
-	dec := json.NewDecoder(strings.NewReader(data))
-	err = dec.Decode(&allData)
-	return
-}
-
-func (session *Session) GetThermostats() (thermostats []Thermostat, err error) {
-	data, err := session.get("/thermostats")
-	if err != nil {
-		return thermostats, err
-	}
-
-	var s Devices
-	dec := json.NewDecoder(strings.NewReader(data))
-	if err := dec.Decode(&s); err != nil {
-		return thermostats, err
-	}
-
-	for _, d := range s.Thermostats {
-		thermostats = append(thermostats, d)
-	}
-
-	return
-}
-
-func (session *Session) IsAway(structureId string) (bool, error) {
-	contents, err := session.get("/structures/" + structureId)
-	if err != nil {
-		return false, err
-	}
-
-	var s Structure
-	dec := json.NewDecoder(strings.NewReader(contents))
-	if err := dec.Decode(&s); err != nil {
-		return false, err
-	}
-
-	return s.Away != "home", nil
-}
-
-func (session *Session) SetTargetTemp(nestId string, temp Temperature, hilo HighLow) (t Temperature, err error) {
-	path := fmt.Sprintf("/devices/thermostats/%s/target_temperature_", nestId)
-	if hilo != "" {
-		path += string(hilo) + "_"
-	}
-	path += strings.ToLower(string(temp.Scale()))
-	data, _ := json.Marshal(temp)
-
-	var resp string
-	if resp, err = session.put(path, data); err != nil {
-		return
-	}
-
-	val, err := strconv.ParseFloat(resp, 64)
-	if err != nil {
-		return
-	}
-
-	return NewTemp(val, temp.Scale()), nil
-}
-
-func (session *Session) SetPresence(structureId string, presence Presence) (err error) {
-	path := fmt.Sprintf("/structures//%s/away", structureId)
-	data, _ := json.Marshal(presence)
-
-	var resp string
-	if resp, err = session.put(path, data); err != nil {
-		return
-	}
-
-	log.Printf("got response: %s", resp)
-
-	return nil
-}
-
+// TemperatureScaleName returns the name of the thermostat's display scale.
 func (t *Thermostat) TemperatureScaleName() string {
 	if t.TemperatureScale == ScaleF {
 		return "Fahrenheit"
@@ -242,6 +104,8 @@ func (t *Thermostat) TemperatureScaleName() string {
 	}
 }
 
+// SetTemperatureScale sets the thermostat's display scale from its name,
+// "Fahrenheit" or "Celsius". It only changes t, not the thermostat itself.
 func (t *Thermostat) SetTemperatureScale(name string) (err error) {
 	lname := strings.ToLower(name)
 	if lname == "fahrenheit" {
@@ -254,6 +118,9 @@ func (t *Thermostat) SetTemperatureScale(name string) (err error) {
 	return
 }
 
+// TargetTemperature returns the target temperature in heat or cool mode. If
+// scale is empty, the thermostat's own scale is used; the same is true of the
+// other temperature accessors.
 func (t *Thermostat) TargetTemperature(scale TempScale) Temperature {
 	switch scale {
 	case ScaleF:
@@ -265,6 +132,7 @@ func (t *Thermostat) TargetTemperature(scale TempScale) Temperature {
 	}
 }
 
+// TargetTemperatureHigh returns the upper target in heat-cool mode.
 func (t *Thermostat) TargetTemperatureHigh(scale TempScale) Temperature {
 	switch scale {
 	case ScaleF:
@@ -276,6 +144,7 @@ func (t *Thermostat) TargetTemperatureHigh(scale TempScale) Temperature {
 	}
 }
 
+// TargetTemperatureLow returns the lower target in heat-cool mode.
 func (t *Thermostat) TargetTemperatureLow(scale TempScale) Temperature {
 	switch scale {
 	case ScaleF:
@@ -287,6 +156,8 @@ func (t *Thermostat) TargetTemperatureLow(scale TempScale) Temperature {
 	}
 }
 
+// AwayTemperatureHigh returns the upper limit used while the structure is
+// away.
 func (t *Thermostat) AwayTemperatureHigh(scale TempScale) Temperature {
 	switch scale {
 	case ScaleF:
@@ -298,6 +169,8 @@ func (t *Thermostat) AwayTemperatureHigh(scale TempScale) Temperature {
 	}
 }
 
+// AwayTemperatureLow returns the lower limit used while the structure is
+// away.
 func (t *Thermostat) AwayTemperatureLow(scale TempScale) Temperature {
 	switch scale {
 	case ScaleF:
@@ -309,6 +182,7 @@ func (t *Thermostat) AwayTemperatureLow(scale TempScale) Temperature {
 	}
 }
 
+// AmbientTemperature returns the temperature measured by the thermostat.
 func (t *Thermostat) AmbientTemperature(scale TempScale) Temperature {
 	switch scale {
 	case ScaleF:
@@ -319,67 +193,3 @@ func (t *Thermostat) AmbientTemperature(scale TempScale) Temperature {
 		return t.AmbientTemperature(t.TemperatureScale)
 	}
 }
-
-// support /////////////////////////////////////////////////////////////
-
-var client = &http.Client{}
-
-func (session *Session) rawRequest(method, uri string, data []byte, follow int) (out string, err error) {
-	var request *http.Request
-	if data != nil {
-		request, err = http.NewRequest(method, uri, bytes.NewReader(data))
-		request.Header.Add("Content-Type", "application/json")
-	} else {
-		request, err = http.NewRequest(method, uri, nil)
-	}
-	if err != nil {
-		return
-	}
-	request.Header.Add("Accept", "application/json")
-
-	log.Printf("request: %#v", request)
-
-	var resp *http.Response
-	if resp, err = client.Do(request); err != nil {
-		return
-	}
-	defer resp.Body.Close()
-
-	log.Printf("response: %#v\n", resp)
-	if resp.StatusCode >= 400 {
-		return "", fmt.Errorf(resp.Status)
-	}
-
-	if resp.StatusCode == 307 && follow > 0 {
-		uri := resp.Header.Get("Location")
-		return session.rawRequest(method, uri, data, follow-1)
-	}
-
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-
-	return string(content), nil
-}
-
-func (session *Session) request(method, path string, data []byte) (out string, err error) {
-	q := url.Values{}
-	q.Set("auth", session.token)
-
-	reqUri := ApiHost + path + "?" + q.Encode()
-
-	return session.rawRequest(method, reqUri, data, 3)
-}
-
-func (session *Session) get(path string) (string, error) {
-	return session.request("GET", path, nil)
-}
-
-func (session *Session) put(path string, data []byte) (string, error) {
-	return session.request("PUT", path, data)
-}
-
-func (session *Session) patch(path string, data []byte) (string, error) {
-	return session.request("PATCH", path, data)
-}
@@ -0,0 +1,315 @@
+package nest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/go-log"
+)
+
+// ApiHost is the root of the Nest REST API.
+const ApiHost = "https://developer-api.nest.com"
+
+// DefaultTimeout is how long requests made by OpenSession's client may take,
+// including redirects and reading the response.
+const DefaultTimeout = 30 * time.Second
+
+// Session makes requests to the Nest API with an access token.
+type Session struct {
+	token string
+
+	// Host is the root of the API, ApiHost by default.
+	Host string
+
+	// Client sends the session's requests. Its Timeout bounds each request.
+	Client *http.Client
+
+	// OnRequest, if set, is called after every HTTP request to the API,
+	// including each redirect that's followed, with the request method and
+	// any error.
+	OnRequest func(method string, err error)
+}
+
+// OpenSession returns a session that authenticates with token, using a client
+// that times out after DefaultTimeout.
+func OpenSession(token string) *Session {
+	return &Session{
+		token:  token,
+		Host:   ApiHost,
+		Client: &http.Client{Timeout: DefaultTimeout},
+	}
+}
+
+// Error is an error response from the API. Message is the explanation Nest
+// gave, if any.
+type Error struct {
+	StatusCode int
+	Status     string
+	Type       string
+	Message    string
+}
+
+// Error returns the message Nest gave for the error, or the response status.
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.Status
+}
+
+// decodeError returns an Error for a failed response. The body is decoded if
+// it's a JSON error object; otherwise only the status is used.
+func decodeError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode, Status: resp.Status}
+
+	var body struct {
+		Error   string `json:"error"`
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+		apiErr.Type = body.Type
+		apiErr.Message = body.Message
+		if apiErr.Message == "" {
+			apiErr.Message = body.Error
+		}
+	}
+
+	return apiErr
+}
+
+// GetAllData reads everything the token has access to.
+func (session *Session) GetAllData() (allData AllData, err error) {
+	data, err := session.Get("/")
+	if err != nil {
+		return
+	}
+
+	dec := json.NewDecoder(strings.NewReader(data))
+	err = dec.Decode(&allData)
+	return
+}
+
+// GetThermostats reads every thermostat the token has access to.
+func (session *Session) GetThermostats() (thermostats []Thermostat, err error) {
+	data, err := session.Get("/thermostats")
+	if err != nil {
+		return thermostats, err
+	}
+
+	var s Devices
+	dec := json.NewDecoder(strings.NewReader(data))
+	if err := dec.Decode(&s); err != nil {
+		return thermostats, err
+	}
+
+	for _, d := range s.Thermostats {
+		thermostats = append(thermostats, d)
+	}
+
+	return
+}
+
+// IsAway returns true if a structure isn't set to home.
+func (session *Session) IsAway(structureId string) (bool, error) {
+	contents, err := session.Get("/structures/" + structureId)
+	if err != nil {
+		return false, err
+	}
+
+	var s Structure
+	dec := json.NewDecoder(strings.NewReader(contents))
+	if err := dec.Decode(&s); err != nil {
+		return false, err
+	}
+
+	return s.Away != "home", nil
+}
+
+// ThermostatPath returns the API path of a thermostat field.
+func ThermostatPath(nestId, field string) string {
+	return fmt.Sprintf("/devices/thermostats/%s/%s", nestId, field)
+}
+
+// StructurePath returns the API path of a structure field.
+func StructurePath(structureId, field string) string {
+	return fmt.Sprintf("/structures/%s/%s", structureId, field)
+}
+
+// TargetTempField returns the name of the thermostat field that holds a
+// target temperature of the given scale and type.
+func TargetTempField(scale TempScale, hilo HighLow) string {
+	field := "target_temperature_"
+	if hilo != "" {
+		field += string(hilo) + "_"
+	}
+	return field + strings.ToLower(string(scale))
+}
+
+// SetTargetTemp sets a thermostat's target temperature, or in heat-cool mode
+// the target selected by hilo. It returns the temperature Nest accepted.
+func (session *Session) SetTargetTemp(nestId string, temp Temperature, hilo HighLow) (t Temperature, err error) {
+	path := ThermostatPath(nestId, TargetTempField(temp.Scale(), hilo))
+	data, _ := json.Marshal(temp)
+
+	var resp string
+	if resp, err = session.Put(path, data); err != nil {
+		return
+	}
+
+	val, err := strconv.ParseFloat(resp, 64)
+	if err != nil {
+		return
+	}
+
+	return NewTemp(val, temp.Scale()), nil
+}
+
+// SetTargetRange sets both targets used in heat-cool mode. The targets are
+// written separately so each write addresses a single field.
+func (session *Session) SetTargetRange(nestId string, low, high Temperature) (err error) {
+	if high.Scale() != low.Scale() {
+		high = ConvertTemp(high, low.Scale())
+	}
+	if _, err = session.SetTargetTemp(nestId, low, TypeLow); err != nil {
+		return
+	}
+	_, err = session.SetTargetTemp(nestId, high, TypeHigh)
+	return
+}
+
+// SetFanTimer turns a thermostat's fan timer on or off.
+func (session *Session) SetFanTimer(nestId string, on bool) (err error) {
+	data, _ := json.Marshal(on)
+	_, err = session.Put(ThermostatPath(nestId, "fan_timer_active"), data)
+	return
+}
+
+// SetPresence sets whether anyone is home at a structure.
+func (session *Session) SetPresence(structureId string, presence Presence) (err error) {
+	path := StructurePath(structureId, "away")
+	data, _ := json.Marshal(presence)
+
+	var resp string
+	if resp, err = session.Put(path, data); err != nil {
+		return
+	}
+
+	log.Printf("got response: %s", resp)
+
+	return nil
+}
+
+// SetHvacMode sets a thermostat's heating and cooling mode.
+func (session *Session) SetHvacMode(nestId string, mode HvacMode) (err error) {
+	switch mode {
+	case ModeHeat, ModeCool, ModeRange, ModeOff:
+	default:
+		return errors.New("Invalid HVAC mode '" + string(mode) + "'")
+	}
+
+	path := ThermostatPath(nestId, "hvac_mode")
+	data, _ := json.Marshal(mode)
+
+	var resp string
+	if resp, err = session.Put(path, data); err != nil {
+		return
+	}
+
+	log.Printf("got response: %s", resp)
+
+	return nil
+}
+
+func (session *Session) requested(method string, err error) {
+	if session.OnRequest != nil {
+		session.OnRequest(method, err)
+	}
+}
+
+func (session *Session) rawRequest(method, uri string, data []byte, follow int) (out string, err error) {
+	var request *http.Request
+	if data != nil {
+		request, err = http.NewRequest(method, uri, bytes.NewReader(data))
+		if err == nil {
+			request.Header.Add("Content-Type", "application/json")
+		}
+	} else {
+		request, err = http.NewRequest(method, uri, nil)
+	}
+	if err != nil {
+		return
+	}
+	request.Header.Add("Accept", "application/json")
+
+	log.Printf("request: %s %s", method, request.URL.Path)
+
+	client := session.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var resp *http.Response
+	if resp, err = client.Do(request); err != nil {
+		session.requested(method, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	log.Printf("response: %s", resp.Status)
+	if resp.StatusCode >= 400 {
+		err = decodeError(resp)
+		session.requested(method, err)
+		return "", err
+	}
+	session.requested(method, nil)
+
+	if resp.StatusCode == 307 && follow > 0 {
+		uri := resp.Header.Get("Location")
+		return session.rawRequest(method, uri, data, follow-1)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+func (session *Session) request(method, path string, data []byte) (out string, err error) {
+	q := url.Values{}
+	q.Set("auth", session.token)
+
+	host := session.Host
+	if host == "" {
+		host = ApiHost
+	}
+	reqUri := host + path + "?" + q.Encode()
+
+	return session.rawRequest(method, reqUri, data, 3)
+}
+
+// Get reads the JSON value at an API path.
+func (session *Session) Get(path string) (string, error) {
+	return session.request("GET", path, nil)
+}
+
+// Put replaces the JSON value at an API path and returns the value Nest
+// stored.
+func (session *Session) Put(path string, data []byte) (string, error) {
+	return session.request("PUT", path, data)
+}
+
+// Patch merges a JSON object into the value at an API path.
+func (session *Session) Patch(path string, data []byte) (string, error) {
+	return session.request("PATCH", path, data)
+}
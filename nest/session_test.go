@@ -0,0 +1,254 @@
+package nest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// request is an HTTP request received by a test server.
+type request struct {
+	method      string
+	path        string
+	auth        string
+	contentType string
+	body        string
+}
+
+// newTestSession returns a session that sends requests to a server replying
+// with status and body, and a channel receiving each request the server gets.
+func newTestSession(t *testing.T, status int, body string) (*Session, <-chan request) {
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		requests <- request{
+			method:      r.Method,
+			path:        r.URL.Path,
+			auth:        r.URL.Query().Get("auth"),
+			contentType: r.Header.Get("Content-Type"),
+			body:        string(data),
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	session := OpenSession("token")
+	session.Host = server.URL
+	return session, requests
+}
+
+func TestOpenSession(t *testing.T) {
+	session := OpenSession("token")
+	if session.Host != ApiHost {
+		t.Errorf("Host = %q, want %q", session.Host, ApiHost)
+	}
+	if session.Client == nil || session.Client.Timeout != DefaultTimeout {
+		t.Errorf("Client doesn't time out after %s", DefaultTimeout)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		call     func(s *Session) error
+		want     request
+	}{
+		{
+			name:     "get all data",
+			response: "{}",
+			call: func(s *Session) error {
+				_, err := s.GetAllData()
+				return err
+			},
+			want: request{method: "GET", path: "/"},
+		},
+		{
+			name:     "set target temperature",
+			response: "68.5",
+			call: func(s *Session) error {
+				_, err := s.SetTargetTemp("t1", TempF(68.5), "")
+				return err
+			},
+			want: request{
+				method:      "PUT",
+				path:        "/devices/thermostats/t1/target_temperature_f",
+				contentType: "application/json",
+				body:        "68.5",
+			},
+		},
+		{
+			name:     "set low target temperature",
+			response: "20",
+			call: func(s *Session) error {
+				_, err := s.SetTargetTemp("t1", TempC(20), TypeLow)
+				return err
+			},
+			want: request{
+				method:      "PUT",
+				path:        "/devices/thermostats/t1/target_temperature_low_c",
+				contentType: "application/json",
+				body:        "20",
+			},
+		},
+		{
+			name:     "set mode",
+			response: `"heat"`,
+			call: func(s *Session) error {
+				return s.SetHvacMode("t1", ModeHeat)
+			},
+			want: request{
+				method:      "PUT",
+				path:        "/devices/thermostats/t1/hvac_mode",
+				contentType: "application/json",
+				body:        `"heat"`,
+			},
+		},
+		{
+			name:     "set presence",
+			response: `"away"`,
+			call: func(s *Session) error {
+				return s.SetPresence("s1", Away)
+			},
+			want: request{
+				method:      "PUT",
+				path:        "/structures/s1/away",
+				contentType: "application/json",
+				body:        `"away"`,
+			},
+		},
+		{
+			name:     "set fan timer",
+			response: "true",
+			call: func(s *Session) error {
+				return s.SetFanTimer("t1", true)
+			},
+			want: request{
+				method:      "PUT",
+				path:        "/devices/thermostats/t1/fan_timer_active",
+				contentType: "application/json",
+				body:        "true",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		session, requests := newTestSession(t, http.StatusOK, test.response)
+		if err := test.call(session); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		got := <-requests
+		test.want.auth = "token"
+		if got != test.want {
+			t.Errorf("%s: got request %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSetTargetTempResult(t *testing.T) {
+	session, _ := newTestSession(t, http.StatusOK, "69")
+	got, err := session.SetTargetTemp("t1", TempF(68.5), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != TempF(69) {
+		t.Errorf("SetTargetTemp returned %s, want 69°F", got)
+	}
+}
+
+func TestInvalidMode(t *testing.T) {
+	session, requests := newTestSession(t, http.StatusOK, "")
+	if err := session.SetHvacMode("t1", "eco"); err == nil {
+		t.Error("SetHvacMode accepted an invalid mode")
+	}
+	if len(requests) != 0 {
+		t.Error("SetHvacMode sent a request for an invalid mode")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		message string
+		errType string
+	}{
+		{
+			name:    "message",
+			status:  http.StatusBadRequest,
+			body:    `{"error":"Invalid value","type":"https://developer.nest.com/documentation/cloud/error-messages#invalid-value","message":"Invalid value for Away"}`,
+			message: "Invalid value for Away",
+			errType: "https://developer.nest.com/documentation/cloud/error-messages#invalid-value",
+		},
+		{
+			name:    "error only",
+			status:  http.StatusUnauthorized,
+			body:    `{"error":"unauthorized"}`,
+			message: "unauthorized",
+		},
+		{
+			name:    "not JSON",
+			status:  http.StatusServiceUnavailable,
+			body:    "<html>Service Unavailable</html>",
+			message: "503 Service Unavailable",
+		},
+		{
+			name:    "empty",
+			status:  http.StatusNotFound,
+			message: "404 Not Found",
+		},
+	}
+
+	for _, test := range tests {
+		session, _ := newTestSession(t, test.status, test.body)
+
+		var requested []string
+		session.OnRequest = func(method string, err error) {
+			if err != nil {
+				requested = append(requested, method+" failed")
+			} else {
+				requested = append(requested, method)
+			}
+		}
+
+		err := session.SetPresence("s1", Away)
+		apiErr, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%s: got error %#v, want *Error", test.name, err)
+			continue
+		}
+		if apiErr.StatusCode != test.status {
+			t.Errorf("%s: StatusCode = %d, want %d", test.name, apiErr.StatusCode, test.status)
+		}
+		if apiErr.Error() != test.message {
+			t.Errorf("%s: Error() = %q, want %q", test.name, apiErr.Error(), test.message)
+		}
+		if apiErr.Type != test.errType {
+			t.Errorf("%s: Type = %q, want %q", test.name, apiErr.Type, test.errType)
+		}
+		if len(requested) != 1 || requested[0] != "PUT failed" {
+			t.Errorf("%s: OnRequest got %v, want [PUT failed]", test.name, requested)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	session := OpenSession("token")
+	session.Host = server.URL
+	session.Client.Timeout = 50 * time.Millisecond
+
+	if _, err := session.GetAllData(); err == nil {
+		t.Error("request didn't time out")
+	}
+}
@@ -0,0 +1,96 @@
+package nest
+
+import (
+	"math"
+	"strconv"
+)
+
+// TempF is a temperature in Fahrenheit.
+type TempF float64
+
+// TempC is a temperature in Celsius.
+type TempC float64
+
+// Humidity is a relative humidity percentage.
+type Humidity float64
+
+// TempScale is a temperature scale, "C" or "F".
+type TempScale string
+
+// HighLow selects the upper or lower target temperature in heat-cool mode.
+type HighLow string
+
+// Temperature scales and heat-cool targets
+const (
+	ScaleC   = TempScale("C")
+	ScaleF   = TempScale("F")
+	TypeHigh = HighLow("high")
+	TypeLow  = HighLow("low")
+)
+
+// Temperature is a temperature in a particular scale.
+type Temperature interface {
+	Value() float64
+	Scale() TempScale
+	String() string
+}
+
+// NewTemp returns a temperature in the given scale.
+func NewTemp(value float64, scale TempScale) Temperature {
+	if scale == ScaleF {
+		return TempF(value)
+	} else {
+		return TempC(value)
+	}
+}
+
+// Value returns the temperature in degrees Fahrenheit.
+func (t TempF) Value() float64 {
+	return float64(t)
+}
+
+// Scale returns ScaleF.
+func (t TempF) Scale() TempScale {
+	return ScaleF
+}
+
+// String formats the temperature with a °F suffix, e.g. "68.5°F".
+func (t TempF) String() string {
+	return strconv.FormatFloat(float64(t), 'f', -1, 64) + "°F"
+}
+
+// Value returns the temperature in degrees Celsius.
+func (t TempC) Value() float64 {
+	return float64(t)
+}
+
+// Scale returns ScaleC.
+func (t TempC) Scale() TempScale {
+	return ScaleC
+}
+
+// String formats the temperature with a °C suffix, e.g. "20.5°C".
+func (t TempC) String() string {
+	return strconv.FormatFloat(float64(t), 'f', -1, 64) + "°C"
+}
+
+// String formats the humidity with a % suffix, e.g. "45%".
+func (h Humidity) String() string {
+	return strconv.FormatFloat(float64(h), 'f', -1, 64) + "%"
+}
+
+// ConvertTemp returns a temperature in another scale, rounded to one decimal
+// place.
+func ConvertTemp(t Temperature, scale TempScale) Temperature {
+	if t.Scale() == scale {
+		return t
+	}
+
+	value := t.Value()
+	if scale == ScaleF {
+		value = value*9/5 + 32
+	} else {
+		value = (value - 32) * 5 / 9
+	}
+	return NewTemp(math.Floor(value*10+0.5)/10, scale)
+}
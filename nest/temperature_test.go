@@ -0,0 +1,69 @@
+package nest
+
+import "testing"
+
+func TestNewTemp(t *testing.T) {
+	tests := []struct {
+		value  float64
+		scale  TempScale
+		want   Temperature
+		string string
+	}{
+		{68, ScaleF, TempF(68), "68°F"},
+		{20.5, ScaleC, TempC(20.5), "20.5°C"},
+		{20, "", TempC(20), "20°C"},
+	}
+
+	for _, test := range tests {
+		got := NewTemp(test.value, test.scale)
+		if got != test.want {
+			t.Errorf("NewTemp(%v, %q) = %#v, want %#v", test.value, test.scale, got, test.want)
+		}
+		if got.String() != test.string {
+			t.Errorf("NewTemp(%v, %q).String() = %q, want %q", test.value, test.scale, got.String(),
+				test.string)
+		}
+	}
+}
+
+func TestConvertTemp(t *testing.T) {
+	tests := []struct {
+		temp  Temperature
+		scale TempScale
+		want  Temperature
+	}{
+		{TempF(68), ScaleF, TempF(68)},
+		{TempC(20), ScaleC, TempC(20)},
+		{TempF(32), ScaleC, TempC(0)},
+		{TempF(212), ScaleC, TempC(100)},
+		{TempF(70), ScaleC, TempC(21.1)},
+		{TempF(-40), ScaleC, TempC(-40)},
+		{TempC(0), ScaleF, TempF(32)},
+		{TempC(21.5), ScaleF, TempF(70.7)},
+		{TempC(-17.8), ScaleF, TempF(0)},
+	}
+
+	for _, test := range tests {
+		got := ConvertTemp(test.temp, test.scale)
+		if got != test.want {
+			t.Errorf("ConvertTemp(%s, %s) = %s, want %s", test.temp, test.scale, got, test.want)
+		}
+	}
+}
+
+func TestHumidityString(t *testing.T) {
+	tests := []struct {
+		humidity Humidity
+		want     string
+	}{
+		{45, "45%"},
+		{45.5, "45.5%"},
+		{0, "0%"},
+	}
+
+	for _, test := range tests {
+		if got := test.humidity.String(); got != test.want {
+			t.Errorf("Humidity(%v).String() = %q, want %q", float64(test.humidity), got, test.want)
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,26 +15,111 @@ import (
 	"os"
 	"strings"
 	"time"
-
-	"github.com/jason0x43/go-alfred"
 )
 
-var OauthApiHost = "https://api.home.nest.com/oauth2/access_token"
 var OauthTitle = "Alfred Nest"
 
+// refreshMargin is how long before AccessExpiry the access token is refreshed
+const refreshMargin = 5 * time.Minute
+
 var listener net.Listener
 
 type closeableListener struct {
 	net.Listener
 }
 
+// pendingAuth holds the values an authorization request was started with,
+// which the callback needs to check the response and redeem the code.
+type pendingAuth struct {
+	State    string
+	Verifier string
+}
+
+// newPendingAuth returns a random state and PKCE code verifier.
+func newPendingAuth() (auth pendingAuth, err error) {
+	if auth.State, err = randomString(32); err != nil {
+		return
+	}
+	auth.Verifier, err = randomString(32)
+	return
+}
+
+// Challenge returns the S256 PKCE code challenge for the verifier.
+func (a pendingAuth) Challenge() string {
+	sum := sha256.Sum256([]byte(a.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomString(size int) (string, error) {
+	randBytes := make([]byte, size)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randBytes), nil
+}
+
+// authorizationUrl returns the URL of the page where the user grants access.
+// Parameters already in the configured URL, such as Google's access_type, are
+// kept. The redirect URI is only sent if it's been changed, since Nest uses
+// the one registered for the client.
+func authorizationUrl(auth pendingAuth) (string, error) {
+	settings := oauthSettings()
+	u, err := url.Parse(settings.AuthUrl)
+	if err != nil {
+		return "", err
+	}
+
+	params := u.Query()
+	params.Set("client_id", settings.ClientId)
+	params.Set("response_type", "code")
+	params.Set("state", auth.State)
+	params.Set("code_challenge", auth.Challenge())
+	params.Set("code_challenge_method", "S256")
+	if settings.RedirectUri != DefaultRedirectUri {
+		params.Set("redirect_uri", settings.RedirectUri)
+	}
+	if settings.Scope != "" {
+		params.Set("scope", settings.Scope)
+	}
+
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+// loadPendingAuth returns the authorization request saved by the authorize
+// command.
+func loadPendingAuth() (auth pendingAuth, err error) {
+	if err = loadJson(authFile, &auth); err != nil {
+		return
+	}
+	if auth.Verifier == "" {
+		err = errors.New("No authorization in progress; run authorize first")
+	}
+	return
+}
+
+// StartAuthServer waits for the OAuth callback for the authorization request
+// saved in authFile. The request's state and verifier are read from the file
+// rather than passed in, so they never appear on a command line.
 func StartAuthServer() (err error) {
-	listener, err = net.Listen("tcp", ":"+CallbackPort)
+	auth, err := loadPendingAuth()
+	if err != nil {
+		return
+	}
+
+	addr, path, err := callbackAddress(oauthSettings().RedirectUri)
 	if err != nil {
 		return
 	}
 
-	http.HandleFunc(CallbackPath, oauthHandler)
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		oauthHandler(w, r, auth)
+	})
 	return http.Serve(closeableListener{listener}, nil)
 }
 
@@ -46,7 +135,7 @@ func (l closeableListener) Accept() (c net.Conn, err error) {
 	return
 }
 
-func oauthHandler(w http.ResponseWriter, r *http.Request) {
+func oauthHandler(w http.ResponseWriter, r *http.Request, auth pendingAuth) {
 	log.Println("Received OAuth request")
 
 	params, err := url.ParseQuery(r.URL.RawQuery)
@@ -54,66 +143,148 @@ func oauthHandler(w http.ResponseWriter, r *http.Request) {
 		log.Fatal("error parsing query:", err)
 	}
 
-	oauth_params := url.Values{}
-	oauth_params.Set("code", params.Get("code"))
-	oauth_params.Set("client_id", ClientId)
-	oauth_params.Set("client_secret", ClientSecret)
-	oauth_params.Set("grant_type", "authorization_code")
+	if params.Get("state") != auth.State {
+		// not a response to our request; keep waiting for it
+		log.Println("Ignoring OAuth response with unknown state")
+		writeResponse("<h1>Authorization failed</h1><p>"+
+			"The response didn’t match the request.</p>", "fail", w, r)
+		return
+	}
 
-	log.Println("POSTing to " + OauthApiHost)
+	if err := redeemCode(params.Get("code"), auth.Verifier); err != nil {
+		writeResponse("<h1>Authorization failed</h1><p>"+
+			err.Error()+"</p>", "fail", w, r)
+	} else {
+		os.Remove(authFile)
+		writeResponse("<h1>Authorization was successful!</h1>"+
+			"<p>You may now close this window/tab.</p>", "success", w, r)
+	}
 
-	req, err := http.NewRequest("POST", OauthApiHost, strings.NewReader(oauth_params.Encode()))
+	log.Printf("Shutting down...")
+	listener.Close()
+}
+
+// redeemCode exchanges an authorization code for tokens and saves them.
+func redeemCode(code, verifier string) error {
+	params := url.Values{}
+	params.Set("code", code)
+	params.Set("grant_type", "authorization_code")
+	params.Set("code_verifier", verifier)
+	if settings := oauthSettings(); settings.RedirectUri != DefaultRedirectUri {
+		params.Set("redirect_uri", settings.RedirectUri)
+	}
+
+	tokens, err := requestToken(params)
+	if err != nil {
+		return err
+	}
+	return updateConfig(func(c *Config) error {
+		tokens.save(c)
+		return nil
+	})
+}
+
+// tokenResponse holds the tokens returned by the OAuth token endpoint.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	received     time.Time
+}
+
+// save stores the tokens in c. Servers only send a new refresh token if they
+// rotate them, so an existing one is kept otherwise.
+func (t *tokenResponse) save(c *Config) {
+	c.AccessToken = t.AccessToken
+	c.AccessExpiry = t.received.Add(time.Duration(t.ExpiresIn) * time.Second)
+	if t.RefreshToken != "" {
+		c.RefreshToken = t.RefreshToken
+	}
+}
+
+// oauthClient makes token requests
+var oauthClient = &http.Client{Timeout: 30 * time.Second}
+
+// requestToken POSTs a token request to the OAuth endpoint and returns the
+// tokens it sends back. The client secret is only sent if there is one; PKCE
+// protects the authorization code without it. It doesn't touch the config,
+// so callers can make the request without holding the config lock.
+func requestToken(params url.Values) (tokens tokenResponse, err error) {
+	settings := oauthSettings()
+	params.Set("client_id", settings.ClientId)
+	if settings.ClientSecret != "" {
+		params.Set("client_secret", settings.ClientSecret)
+	}
+
+	log.Println("POSTing to " + settings.TokenUrl)
+
+	req, err := http.NewRequest("POST", settings.TokenUrl, strings.NewReader(params.Encode()))
+	if err != nil {
+		return
+	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := oauthClient.Do(req)
 	if err != nil {
-		log.Fatal("error POSTing to Nest:", err)
+		return
 	}
 	defer resp.Body.Close()
 
 	content, err := ioutil.ReadAll(resp.Body)
-
 	if err != nil {
-		log.Println("error reading response:", err)
-		writeResponse("<h1>Authorization failed</h1><p>"+
-			err.Error()+"</p>", "fail", w, r)
-	} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
 		log.Printf("bad response code (%d): %s", resp.StatusCode, content)
-		writeResponse("<h1>Authorization failed</h1><p>"+
-			string(content)+"</p>", "fail", w, r)
-	} else {
-		var message struct {
-			AccessToken string `json:"access_token"`
-			ExpiresIn   int64  `json:"expires_in"`
-		}
+		return tokens, fmt.Errorf("%s: %s", resp.Status, content)
+	}
+
+	if err = json.Unmarshal(content, &tokens); err != nil {
+		return
+	}
+	if tokens.AccessToken == "" {
+		return tokens, errors.New("No access token in response")
+	}
+	tokens.received = time.Now()
+	return
+}
+
+// needsRefresh returns true if a config's access token is about to expire and
+// can be refreshed.
+func needsRefresh(c *Config) bool {
+	return c.RefreshToken != "" && time.Now().Add(refreshMargin).After(c.AccessExpiry)
+}
+
+// freshAccessToken returns the access token, first refreshing it if it's about
+// to expire. The token request is made without the config locked, so other
+// workflow processes aren't blocked on the network. If another process
+// refreshed the token in the meantime, its tokens are kept.
+func freshAccessToken() string {
+	if !needsRefresh(&config) {
+		return config.AccessToken
+	}
+
+	log.Println("Refreshing access token...")
+	refreshToken := config.RefreshToken
+	params := url.Values{}
+	params.Set("grant_type", "refresh_token")
+	params.Set("refresh_token", refreshToken)
 
-		if err := json.Unmarshal(content, &message); err != nil {
-			writeResponse("<h1>Authorization failed</h1><p>"+
-				err.Error()+"</p>", "fail", w, r)
-		} else {
-			log.Printf("Unmarshaled '%s' into %#v\n", string(content), message)
-
-			// save the access token to the workflow config file
-			config.AccessToken = message.AccessToken
-			config.AccessExpiry = time.Now().Add(time.Duration(message.ExpiresIn) * time.Second)
-			err := alfred.SaveJson(configFile, &config)
-
-			if err != nil {
-				writeResponse(`<h1>Authorization failed</h1>
-					<p>The authorization process itself passed, but there was an
-					error saving the token:</p>
-					<pre>`+err.Error()+`</pre>`,
-					"fail", w, r)
-			} else {
-				writeResponse("<h1>Authorization was successful!</h1>"+
-					"<p>You may now close this window/tab.</p>", "success", w, r)
+	tokens, err := requestToken(params)
+	if err == nil {
+		err = updateConfig(func(c *Config) error {
+			if c.RefreshToken == refreshToken {
+				tokens.save(c)
 			}
-		}
+			return nil
+		})
+	}
+	if err != nil {
+		log.Println("Error refreshing access token:", err)
 	}
 
-	log.Printf("Shutting down...")
-	listener.Close()
+	return config.AccessToken
 }
 
 func writeResponse(content, class string, w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// Intent is a change parsed from a natural-language command such as "set
+// upstairs to 70 and heat" or "away until monday". Empty fields are left
+// unchanged. If Until is set, the previous values are restored at that time.
+type Intent struct {
+	DeviceId string
+	HasTemp  bool           `json:",omitempty"`
+	Temp     float64        `json:",omitempty"`
+	Scale    nest.TempScale `json:",omitempty"`
+	HiLo     nest.HighLow   `json:",omitempty"`
+	Mode     nest.HvacMode  `json:",omitempty"`
+	Presence nest.Presence  `json:",omitempty"`
+	Until    time.Time      `json:",omitempty"`
+}
+
+func (i *Intent) IsEmpty() bool {
+	return !i.HasTemp && i.Mode == "" && i.Presence == ""
+}
+
+func (i *Intent) Temperature() nest.Temperature {
+	return nest.NewTemp(i.Temp, i.Scale)
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenNumber
+	tokenTemp
+)
+
+type token struct {
+	text  string
+	kind  tokenKind
+	value float64
+	scale nest.TempScale
+}
+
+var tempPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(°|º)?([fc])?$`)
+
+// tokenize splits a command into lowercase words and numbers. Numbers with a
+// degree sign or scale suffix, like "70f" or "21.5°c", become temperatures.
+func tokenize(query string) (tokens []token) {
+	query = strings.ToLower(strings.NewReplacer(",", " ", ";", " ").Replace(query))
+
+	for _, field := range strings.Fields(query) {
+		if m := tempPattern.FindStringSubmatch(field); m != nil {
+			value, _ := strconv.ParseFloat(m[1], 64)
+			t := token{text: field, kind: tokenNumber, value: value}
+			if m[2] != "" || m[3] != "" {
+				t.kind = tokenTemp
+				t.scale = nest.TempScale(strings.ToUpper(m[3]))
+			}
+			tokens = append(tokens, t)
+		} else {
+			tokens = append(tokens, token{text: field, kind: tokenWord})
+		}
+	}
+
+	return
+}
+
+var fillerWords = map[string]bool{
+	"set": true, "to": true, "the": true, "and": true, "at": true, "in": true,
+	"please": true, "degrees": true, "degree": true, "make": true, "turn": true,
+	"mode": true, "it": true, "i'm": true, "im": true, "be": true, "switch": true,
+}
+
+var modeWords = map[string]nest.HvacMode{
+	"heat": nest.ModeHeat, "heating": nest.ModeHeat, "warm": nest.ModeHeat,
+	"cool": nest.ModeCool, "cooling": nest.ModeCool, "ac": nest.ModeCool,
+	"heat-cool": nest.ModeRange, "range": nest.ModeRange, "auto": nest.ModeRange,
+	"off": nest.ModeOff,
+}
+
+var presenceWords = map[string]nest.Presence{
+	"away": nest.Away, "leaving": nest.Away, "gone": nest.Away,
+	"home": nest.Home, "back": nest.Home,
+	"auto-away": nest.AutoAway,
+}
+
+var durationUnits = map[string]time.Duration{
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+}
+
+var compactDuration = regexp.MustCompile(`^(\d+(?:\.\d+)?)([a-z]+)$`)
+var clockPattern = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?(am|pm)?$`)
+
+// parser walks the token list, filling in an Intent.
+type parser struct {
+	tokens []token
+	pos    int
+	now    time.Time
+	intent Intent
+}
+
+// parseIntent parses a natural-language command. Durations are relative to
+// now. The default Nest is used if the command doesn't name a thermostat.
+func parseIntent(query string, now time.Time) (intent Intent, err error) {
+	p := parser{tokens: tokenize(query), now: now}
+
+	for p.pos < len(p.tokens) {
+		if err = p.parseNext(); err != nil {
+			return
+		}
+	}
+
+	intent = p.intent
+	if intent.DeviceId == "" {
+		intent.DeviceId = config.NestId
+	}
+	if intent.HasTemp && intent.Scale == "" {
+		intent.Scale = config.Scale
+	}
+	if intent.IsEmpty() {
+		err = errors.New("Nothing to change")
+	}
+	return
+}
+
+func (p *parser) next() (t token, ok bool) {
+	if p.pos < len(p.tokens) {
+		t = p.tokens[p.pos]
+		p.pos++
+		return t, true
+	}
+	return
+}
+
+func (p *parser) peek() (t token, ok bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return
+}
+
+func (p *parser) parseNext() error {
+	t, _ := p.next()
+
+	if t.kind == tokenNumber || t.kind == tokenTemp {
+		return p.setTemp(t)
+	}
+
+	if fillerWords[t.text] {
+		return nil
+	}
+
+	if mode, ok := modeWords[t.text]; ok {
+		if p.intent.Mode != "" && p.intent.Mode != mode {
+			return fmt.Errorf("Conflicting modes '%s' and '%s'", p.intent.Mode, mode)
+		}
+		p.intent.Mode = mode
+		return nil
+	}
+
+	if presence, ok := presenceWords[t.text]; ok {
+		if p.intent.Presence != "" && p.intent.Presence != presence {
+			return fmt.Errorf("Conflicting presence '%s' and '%s'", p.intent.Presence, presence)
+		}
+		p.intent.Presence = presence
+		return nil
+	}
+
+	switch t.text {
+	case "for":
+		return p.parseDuration()
+	case "until", "till", "til":
+		return p.parseUntil()
+	}
+
+	p.pos--
+	return p.parseThermostat()
+}
+
+func (p *parser) setTemp(t token) error {
+	if p.intent.HasTemp {
+		return fmt.Errorf("More than one temperature ('%s')", t.text)
+	}
+	p.intent.HasTemp = true
+	p.intent.Temp = t.value
+	p.intent.Scale = t.scale
+
+	// allow "70 f" and "70 degrees c"
+	if next, ok := p.peek(); ok && (next.text == "degrees" || next.text == "degree") {
+		p.pos++
+	}
+	if next, ok := p.peek(); ok && next.kind == tokenWord {
+		switch next.text {
+		case "f", "fahrenheit":
+			p.intent.Scale = nest.ScaleF
+			p.pos++
+		case "c", "celsius":
+			p.intent.Scale = nest.ScaleC
+			p.pos++
+		}
+	}
+	return nil
+}
+
+// parseThermostat matches the longest run of words starting at the current
+// position against the cached thermostat IDs, aliases and names.
+func (p *parser) parseThermostat() error {
+	for end := len(p.tokens); end > p.pos; end-- {
+		var words []string
+		for _, t := range p.tokens[p.pos:end] {
+			words = append(words, t.text)
+		}
+
+		name := strings.Join(words, " ")
+		matches := findThermostats(name, false)
+		if len(matches) > 1 {
+			var names []string
+			for _, t := range matches {
+				names = append(names, t.Name+" ("+t.DeviceId+")")
+			}
+			return fmt.Errorf("'%s' could be %s", name, strings.Join(names, " or "))
+		}
+
+		if len(matches) == 1 {
+			if p.intent.DeviceId != "" && p.intent.DeviceId != matches[0].DeviceId {
+				return errors.New("More than one thermostat named")
+			}
+			p.intent.DeviceId = matches[0].DeviceId
+			p.pos = end
+			return nil
+		}
+	}
+
+	return errors.New("Didn’t understand '" + p.tokens[p.pos].text + "'")
+}
+
+// parseDuration parses the part of "for 2 hours" after "for". Accepts "2
+// hours", "2h", "90 min", "an hour" and "a day".
+func (p *parser) parseDuration() error {
+	t, ok := p.next()
+	if !ok {
+		return errors.New("Expected a duration after 'for'")
+	}
+
+	var amount float64
+	var unit string
+
+	if m := compactDuration.FindStringSubmatch(t.text); m != nil && t.kind == tokenWord {
+		amount, _ = strconv.ParseFloat(m[1], 64)
+		unit = m[2]
+	} else {
+		switch {
+		case t.kind == tokenNumber:
+			amount = t.value
+		case t.text == "a" || t.text == "an":
+			amount = 1
+		default:
+			return errors.New("Expected a duration after 'for', got '" + t.text + "'")
+		}
+
+		u, ok := p.next()
+		if !ok {
+			return errors.New("Expected a unit after '" + t.text + "'")
+		}
+		unit = u.text
+	}
+
+	scale, ok := durationUnits[unit]
+	if !ok {
+		return errors.New("Unknown duration unit '" + unit + "'")
+	}
+
+	return p.setUntil(p.now.Add(time.Duration(amount * float64(scale))))
+}
+
+// parseUntil parses the part of "until monday" after "until". Accepts a
+// weekday name, "tomorrow" or "tonight", optionally followed by a clock time
+// like "8am" or "18:30", or just a clock time. A day without a time means the
+// start of that day. A clock time that has already passed today means
+// tomorrow.
+func (p *parser) parseUntil() error {
+	t, ok := p.next()
+	if !ok {
+		return errors.New("Expected a time after 'until'")
+	}
+
+	// times are built from the date and clock rather than by adding to
+	// midnight, so they're right on days when daylight saving time changes
+	year, month, day := p.now.Date()
+	loc := p.now.Location()
+
+	if hour, minute, ok := parseClock(t); ok {
+		until := time.Date(year, month, day, hour, minute, 0, 0, loc)
+		if !until.After(p.now) {
+			until = time.Date(year, month, day+1, hour, minute, 0, 0, loc)
+		}
+		return p.setUntil(until)
+	}
+
+	var days, hour, minute int
+	switch t.text {
+	case "tomorrow":
+		days = 1
+	case "tonight":
+		hour = 22
+	default:
+		weekday, ok := parseWeekday(t.text)
+		if !ok {
+			return errors.New("Didn’t understand time '" + t.text + "'")
+		}
+		days = (int(weekday) - int(p.now.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+	}
+
+	if next, ok := p.peek(); ok && t.text != "tonight" {
+		if h, m, ok := parseClock(next); ok {
+			p.pos++
+			hour, minute = h, m
+		}
+	}
+
+	return p.setUntil(time.Date(year, month, day+days, hour, minute, 0, 0, loc))
+}
+
+func (p *parser) setUntil(until time.Time) error {
+	if !p.intent.Until.IsZero() {
+		return errors.New("More than one end time")
+	}
+	p.intent.Until = until
+	return nil
+}
+
+// parseClock parses a time of day like "8am", "6:30pm" or "18:30". Bare
+// numbers aren't times, so "until 8" is rejected rather than guessed at.
+func parseClock(t token) (hour, minute int, ok bool) {
+	m := clockPattern.FindStringSubmatch(t.text)
+	if m == nil || (m[2] == "" && m[3] == "") {
+		return 0, 0, false
+	}
+
+	hour, _ = strconv.Atoi(m[1])
+	minute, _ = strconv.Atoi(m[2])
+
+	switch m[3] {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+
+	if hour > 23 || minute > 59 {
+		return 0, 0, false
+	}
+	return hour, minute, true
+}
+
+func parseWeekday(word string) (time.Weekday, bool) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if word == name || (len(word) >= 3 && strings.HasPrefix(name, word)) {
+			return day, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// useTestThermostats replaces the config and cache with two thermostats,
+// "Upstairs" (the default) and "Downstairs" (aliased as "bedroom").
+func useTestThermostats(t *testing.T) {
+	savedConfig, savedCache := config, cache
+	t.Cleanup(func() {
+		config, cache = savedConfig, savedCache
+	})
+
+	config = Config{
+		NestId:  "t1",
+		Scale:   nest.ScaleF,
+		Aliases: map[string]string{"bedroom": "t2"},
+	}
+	cache = Cache{}
+	cache.AllData.Devices.Thermostats = map[string]nest.Thermostat{
+		"t1": {DeviceId: "t1", Name: "Upstairs", StructureId: "s1"},
+		"t2": {DeviceId: "t2", Name: "Downstairs", StructureId: "s1"},
+	}
+}
+
+func testLocation(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	return loc
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []token
+	}{
+		{"", nil},
+		{"Heat  Upstairs", []token{
+			{text: "heat", kind: tokenWord},
+			{text: "upstairs", kind: tokenWord},
+		}},
+		{"set to 70", []token{
+			{text: "set", kind: tokenWord},
+			{text: "to", kind: tokenWord},
+			{text: "70", kind: tokenNumber, value: 70},
+		}},
+		{"70F, 21.5°C; 68°", []token{
+			{text: "70f", kind: tokenTemp, value: 70, scale: nest.ScaleF},
+			{text: "21.5°c", kind: tokenTemp, value: 21.5, scale: nest.ScaleC},
+			{text: "68°", kind: tokenTemp, value: 68},
+		}},
+		{"for 2h until 6:30pm", []token{
+			{text: "for", kind: tokenWord},
+			{text: "2h", kind: tokenWord},
+			{text: "until", kind: tokenWord},
+			{text: "6:30pm", kind: tokenWord},
+		}},
+	}
+
+	for _, test := range tests {
+		got := tokenize(test.query)
+		if len(got) != len(test.want) {
+			t.Errorf("tokenize(%q) = %+v, want %+v", test.query, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("tokenize(%q)[%d] = %+v, want %+v", test.query, i, got[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		text   string
+		hour   int
+		minute int
+		ok     bool
+	}{
+		{"8am", 8, 0, true},
+		{"8pm", 20, 0, true},
+		{"6:30pm", 18, 30, true},
+		{"18:30", 18, 30, true},
+		{"12am", 0, 0, true},
+		{"12pm", 12, 0, true},
+		{"0:05", 0, 5, true},
+		{"8", 0, 0, false},
+		{"24:00", 0, 0, false},
+		{"7:60", 0, 0, false},
+		{"noon", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		hour, minute, ok := parseClock(token{text: test.text, kind: tokenWord})
+		if hour != test.hour || minute != test.minute || ok != test.ok {
+			t.Errorf("parseClock(%q) = %d, %d, %v; want %d, %d, %v", test.text, hour, minute, ok,
+				test.hour, test.minute, test.ok)
+		}
+	}
+}
+
+func TestParseWeekday(t *testing.T) {
+	tests := []struct {
+		word string
+		want time.Weekday
+		ok   bool
+	}{
+		{"monday", time.Monday, true},
+		{"mon", time.Monday, true},
+		{"thurs", time.Thursday, true},
+		{"sun", time.Sunday, true},
+		{"saturday", time.Saturday, true},
+		{"mo", 0, false},
+		{"mondays", 0, false},
+		{"someday", 0, false},
+	}
+
+	for _, test := range tests {
+		got, ok := parseWeekday(test.word)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseWeekday(%q) = %s, %v; want %s, %v", test.word, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseIntent(t *testing.T) {
+	useTestThermostats(t)
+	loc := testLocation(t)
+
+	// the day before daylight saving time starts
+	now := time.Date(2026, 3, 7, 10, 0, 0, 0, loc)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 3, day, hour, minute, 0, 0, loc)
+	}
+
+	tests := []struct {
+		query string
+		want  Intent
+	}{
+		{"heat upstairs to 70", Intent{DeviceId: "t1", Mode: nest.ModeHeat, HasTemp: true, Temp: 70,
+			Scale: nest.ScaleF}},
+		{"cool Downstairs 21c", Intent{DeviceId: "t2", Mode: nest.ModeCool, HasTemp: true, Temp: 21,
+			Scale: nest.ScaleC}},
+		{"set bedroom to 68 degrees f", Intent{DeviceId: "t2", HasTemp: true, Temp: 68,
+			Scale: nest.ScaleF}},
+		{"72", Intent{DeviceId: "t1", HasTemp: true, Temp: 72, Scale: nest.ScaleF}},
+		{"turn it off", Intent{DeviceId: "t1", Mode: nest.ModeOff}},
+		{"away until monday", Intent{DeviceId: "t1", Presence: nest.Away, Until: at(9, 0, 0)}},
+		{"home until sat", Intent{DeviceId: "t1", Presence: nest.Home, Until: at(14, 0, 0)}},
+		{"heat to 72 for 2 hours", Intent{DeviceId: "t1", Mode: nest.ModeHeat, HasTemp: true, Temp: 72,
+			Scale: nest.ScaleF, Until: now.Add(2 * time.Hour)}},
+		{"70 for 90min", Intent{DeviceId: "t1", HasTemp: true, Temp: 70, Scale: nest.ScaleF,
+			Until: now.Add(90 * time.Minute)}},
+		{"cool for an hour", Intent{DeviceId: "t1", Mode: nest.ModeCool, Until: now.Add(time.Hour)}},
+		{"off until tonight", Intent{DeviceId: "t1", Mode: nest.ModeOff, Until: at(7, 22, 0)}},
+		{"away until 6:30pm", Intent{DeviceId: "t1", Presence: nest.Away, Until: at(7, 18, 30)}},
+		{"away until 9am", Intent{DeviceId: "t1", Presence: nest.Away, Until: at(8, 9, 0)}},
+		{"away until tomorrow 8am", Intent{DeviceId: "t1", Presence: nest.Away, Until: at(8, 8, 0)}},
+		{"heat until monday 7:15am", Intent{DeviceId: "t1", Mode: nest.ModeHeat, Until: at(9, 7, 15)}},
+	}
+
+	for _, test := range tests {
+		got, err := parseIntent(test.query, now)
+		if err != nil {
+			t.Errorf("parseIntent(%q) failed: %s", test.query, err)
+			continue
+		}
+		if !got.Until.Equal(test.want.Until) {
+			t.Errorf("parseIntent(%q).Until = %s, want %s", test.query, got.Until, test.want.Until)
+		}
+		got.Until, test.want.Until = time.Time{}, time.Time{}
+		if got != test.want {
+			t.Errorf("parseIntent(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+// TestParseIntentDst checks clock times on the day daylight saving time
+// starts, when the day is only 23 hours long.
+func TestParseIntentDst(t *testing.T) {
+	useTestThermostats(t)
+	loc := testLocation(t)
+	now := time.Date(2026, 3, 8, 1, 0, 0, 0, loc)
+
+	tests := []struct {
+		query string
+		want  time.Time
+	}{
+		{"away until 3am", time.Date(2026, 3, 8, 3, 0, 0, 0, loc)},
+		{"away until 6pm", time.Date(2026, 3, 8, 18, 0, 0, 0, loc)},
+		{"away until tonight", time.Date(2026, 3, 8, 22, 0, 0, 0, loc)},
+		{"away until tomorrow 8am", time.Date(2026, 3, 9, 8, 0, 0, 0, loc)},
+	}
+
+	for _, test := range tests {
+		got, err := parseIntent(test.query, now)
+		if err != nil {
+			t.Errorf("parseIntent(%q) failed: %s", test.query, err)
+			continue
+		}
+		if got.Until.Hour() != test.want.Hour() || !got.Until.Equal(test.want) {
+			t.Errorf("parseIntent(%q).Until = %s, want %s", test.query, got.Until, test.want)
+		}
+	}
+}
+
+func TestParseIntentErrors(t *testing.T) {
+	useTestThermostats(t)
+	now := time.Date(2026, 3, 7, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		query   string
+		message string
+	}{
+		{"", "Nothing to change"},
+		{"upstairs", "Nothing to change"},
+		{"heat cool", "Conflicting modes"},
+		{"away home", "Conflicting presence"},
+		{"70 72", "More than one temperature"},
+		{"heat kitchen", "Didn’t understand 'kitchen'"},
+		{"heat upstairs downstairs", "More than one thermostat"},
+		{"heat for", "Expected a duration"},
+		{"heat for 2 fortnights", "Unknown duration unit"},
+		{"heat until", "Expected a time"},
+		{"heat until 8", "Didn’t understand time '8'"},
+		{"heat for 2h until 6pm", "More than one end time"},
+	}
+
+	for _, test := range tests {
+		_, err := parseIntent(test.query, now)
+		if err == nil {
+			t.Errorf("parseIntent(%q) succeeded, want %q", test.query, test.message)
+		} else if !strings.Contains(err.Error(), test.message) {
+			t.Errorf("parseIntent(%q) failed with %q, want %q", test.query, err, test.message)
+		}
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 
+	"github.com/jason0x43/alfred-nest/nest"
 	"github.com/jason0x43/go-alfred"
 )
 
@@ -30,7 +30,7 @@ func (t PresenceCommand) Items(prefix, query string) (items []alfred.Item, err e
 	thermostat, _ := cache.AllData.Devices.Thermostats[config.NestId]
 	structure, _ := cache.AllData.Structures[thermostat.StructureId]
 
-	addItem := func(a Presence, desc string) {
+	addItem := func(a nest.Presence, desc string) {
 		if alfred.FuzzyMatches(string(a), query) {
 			data := awayMessage{StructureId: structure.StructureId, Away: a}
 			dataString, _ := json.Marshal(data)
@@ -39,14 +39,15 @@ func (t PresenceCommand) Items(prefix, query string) (items []alfred.Item, err e
 				Title:        string(a),
 				SubtitleAll:  desc,
 				Autocomplete: prefix + string(a),
-				Arg:          "away " + string(dataString),
+				Arg:          "presence " + string(dataString),
+				Icon:         presenceIcon(a),
 			}, structure.Away == a))
 		}
 	}
 
-	addItem(Home, "You’re at home")
-	addItem(Away, "You’re away")
-	addItem(AutoAway, "Let Nest figure out if you’re away")
+	addItem(nest.Home, tr("You’re at home"))
+	addItem(nest.Away, tr("You’re away"))
+	addItem(nest.AutoAway, tr("Let Nest figure out if you’re away"))
 
 	return
 }
@@ -57,18 +58,30 @@ func (t PresenceCommand) Do(query string) (out string, err error) {
 		return
 	}
 
-	session := OpenSession(config.AccessToken)
-	err = session.SetPresence(msg.StructureId, msg.Away)
+	change := fieldChange{
+		Target: msg.StructureId,
+		Name:   cache.AllData.Structures[msg.StructureId].Name,
+		Field:  "away",
+		Path:   nest.StructurePath(msg.StructureId, "away"),
+		Value:  msg.Away,
+	}
+
+	queued, err := makeChange(change, func(backend nest.ThermostatBackend) error {
+		return backend.SetPresence(msg.StructureId, msg.Away)
+	})
 	if err != nil {
 		return
 	}
+	if queued {
+		return tr("Offline; will set presence to %s when Nest is reachable", msg.Away), nil
+	}
 
 	scheduleRefresh()
 
-	return fmt.Sprintf("Set presence to %s", msg.Away), err
+	return markSimulated(tr("Set presence to %s", msg.Away)), err
 }
 
 type awayMessage struct {
 	StructureId string
-	Away        Presence
+	Away        nest.Presence
 }
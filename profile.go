@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+// Each profile has its own config, cache, queue, history and audit log, and
+// so its own Nest account. The default profile keeps its files at the top of
+// the workflow's data and cache directories, where they were before profiles
+// existed; other profiles live in "profiles/<name>" subdirectories. The active
+// profile is stored in profiles.json, and may be overridden for a single
+// invocation with the NEST_PROFILE environment variable.
+
+const (
+	DefaultProfile = "default"
+	ProfileEnv     = "NEST_PROFILE"
+)
+
+type Profiles struct {
+	Active string
+}
+
+var validProfileName = regexp.MustCompile(`^[\w-]+$`)
+
+var dataDir string
+var cacheDir string
+var profilesFile string
+var profile string
+
+// profileDirs returns the data and cache directories for a profile.
+func profileDirs(name string) (data, cache string) {
+	if name == DefaultProfile {
+		return dataDir, cacheDir
+	}
+	return path.Join(dataDir, "profiles", name), path.Join(cacheDir, "profiles", name)
+}
+
+// profileFiles returns the config and cache file paths for a profile.
+func profileFiles(name string) (configPath, cachePath string) {
+	data, cache := profileDirs(name)
+	return path.Join(data, "config.json"), path.Join(cache, "cache.json")
+}
+
+// activeProfile returns the name of the profile this process should use.
+func activeProfile() string {
+	if name := os.Getenv(ProfileEnv); name != "" {
+		return name
+	}
+
+	var profiles Profiles
+	if err := loadJson(profilesFile, &profiles); err != nil {
+		log.Println("Error loading profiles:", err)
+	}
+	if profiles.Active == "" {
+		return DefaultProfile
+	}
+	return profiles.Active
+}
+
+// useProfile points the workflow's file paths at a profile's directories,
+// creating them if necessary.
+func useProfile(name string) error {
+	if !validProfileName.MatchString(name) {
+		return errors.New("Invalid profile name '" + name + "'")
+	}
+
+	data, cache := profileDirs(name)
+	for _, dir := range []string{data, cache} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	profile = name
+	configFile, cacheFile = profileFiles(name)
+	queueFile = path.Join(data, "queue.json")
+	historyFile = path.Join(data, "history.json")
+	auditFile = path.Join(data, "audit.log")
+	scheduleFile = path.Join(data, "schedule.json")
+	samplesFile = path.Join(data, "samples.json")
+	authFile = path.Join(data, "auth.json")
+	return nil
+}
+
+// listProfiles returns the names of all profiles, starting with the default.
+func listProfiles() (names []string) {
+	names = append(names, DefaultProfile)
+
+	infos, err := ioutil.ReadDir(path.Join(dataDir, "profiles"))
+	if err != nil {
+		return
+	}
+
+	var others []string
+	for _, info := range infos {
+		if info.IsDir() && validProfileName.MatchString(info.Name()) && info.Name() != DefaultProfile {
+			others = append(others, info.Name())
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// loadProfile reads another profile's config and cache without making it
+// active.
+func loadProfile(name string) (c Config, ch Cache, err error) {
+	configPath, cachePath := profileFiles(name)
+	if err = loadJson(configPath, &c); err != nil {
+		return
+	}
+	err = loadJson(cachePath, &ch)
+	return
+}
+
+// refreshProfileInBackground starts a detached refresh for an inactive
+// profile, unless one was started recently.
+func refreshProfileInBackground(name string) {
+	_, cachePath := profileFiles(name)
+
+	started := false
+	var c Cache
+	err := updateJson(cachePath, &c, func() error {
+		if time.Now().Sub(c.RefreshStarted) < backgroundRefreshTimeout {
+			return errors.New("refresh already started")
+		}
+		c.Version = CacheVersion
+		c.RefreshStarted = time.Now()
+		started = true
+		return nil
+	})
+	if !started {
+		if err != nil {
+			log.Printf("Not refreshing profile %s: %s", name, err)
+		}
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "do", "refresh")
+	cmd.Env = append(os.Environ(), ProfileEnv+"="+name)
+	if err := cmd.Start(); err != nil {
+		log.Printf("Error starting refresh for profile %s: %s", name, err)
+	}
+}
+
+// profile -----------------------------------------------
+
+type ProfileCommand struct{}
+
+func (c ProfileCommand) Keyword() string {
+	return "profile"
+}
+
+func (c ProfileCommand) IsEnabled() bool {
+	return true
+}
+
+func (c ProfileCommand) MenuItem() alfred.Item {
+	return alfred.NewKeywordItem(c.Keyword(), "", " ", "Switch between Nest accounts")
+}
+
+func (c ProfileCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	exists := false
+
+	for _, name := range listProfiles() {
+		if name == query {
+			exists = true
+		}
+		if !alfred.FuzzyMatches(name, query) {
+			continue
+		}
+
+		var subtitle string
+		if profileConfig, _, err := loadProfile(name); err != nil {
+			subtitle = tr("Unreadable config: %s", err)
+		} else if !hasAuthorization(&profileConfig) {
+			subtitle = tr("Not authorized")
+		} else {
+			subtitle = tr("Authorized")
+		}
+
+		data, _ := json.Marshal(profileMessage{Name: name})
+		items = append(items, alfred.MakeChoice(alfred.Item{
+			Title:        name,
+			SubtitleAll:  subtitle,
+			Autocomplete: prefix + name,
+			Arg:          "profile " + string(data),
+		}, name == profile))
+	}
+
+	if query != "" && !exists {
+		if validProfileName.MatchString(query) {
+			data, _ := json.Marshal(profileMessage{Name: query})
+			items = append(items, alfred.Item{
+				Title:       tr("Create profile '%s'", query),
+				SubtitleAll: tr("Add and switch to a new profile"),
+				Arg:         "profile " + string(data),
+			})
+		} else if len(items) == 0 {
+			items = append(items, alfred.Item{
+				Title:       tr("Invalid profile name"),
+				SubtitleAll: tr("Use letters, numbers, '-' and '_'"),
+				Valid:       alfred.Invalid,
+			})
+		}
+	}
+
+	return
+}
+
+func (c ProfileCommand) Do(query string) (out string, err error) {
+	var msg profileMessage
+	if err = json.Unmarshal([]byte(query), &msg); err != nil {
+		return
+	}
+
+	if err = useProfile(msg.Name); err != nil {
+		return
+	}
+
+	var profiles Profiles
+	err = updateJson(profilesFile, &profiles, func() error {
+		profiles.Active = msg.Name
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	return tr("Switched to profile '%s'", msg.Name), nil
+}
+
+type profileMessage struct {
+	Name string
+}
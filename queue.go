@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+// PendingWrite is a change that couldn't be sent to Nest because the network
+// was unavailable. Target is a thermostat or structure ID, and Path is the API
+// path the value will be PUT to.
+type PendingWrite struct {
+	Target string
+	Name   string
+	Field  string
+	Path   string
+	Value  json.RawMessage
+	Time   time.Time
+}
+
+func (w PendingWrite) String() string {
+	return fmt.Sprintf("%s %s = %s", w.Name, w.Field, w.Value)
+}
+
+type WriteQueue struct {
+	Writes []PendingWrite
+}
+
+// isNetworkError returns true if err indicates that Nest couldn't be reached,
+// as opposed to Nest rejecting a request.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// queueWrite persists a write to be replayed when the network is available.
+func queueWrite(target, name, field, path string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	var queue WriteQueue
+	return updateJson(queueFile, &queue, func() error {
+		queue.Writes = append(queue.Writes, PendingWrite{
+			Target: target,
+			Name:   name,
+			Field:  field,
+			Path:   path,
+			Value:  data,
+			Time:   time.Now(),
+		})
+		return nil
+	})
+}
+
+// dropQueuedWrites removes the pending writes to a path, so an undone change
+// isn't sent later.
+func dropQueuedWrites(path string) error {
+	var queue WriteQueue
+	return updateJson(queueFile, &queue, func() error {
+		var writes []PendingWrite
+		for _, w := range queue.Writes {
+			if w.Path != path {
+				writes = append(writes, w)
+			}
+		}
+		queue.Writes = writes
+		return nil
+	})
+}
+
+// loadQueue returns the pending writes.
+func loadQueue() (queue WriteQueue, err error) {
+	err = loadJson(queueFile, &queue)
+	return
+}
+
+// replayQueue sends pending writes to Nest in the order they were made. A
+// write is skipped if a newer write to the same path is also queued. If the
+// network is still unavailable, the remaining writes are queued again, ahead
+// of any queued during the replay. Writes that Nest rejects are dropped.
+//
+// The queue is only locked while it's read and cleared and while failed writes
+// are put back, so a slow connection doesn't hold up queueWrite. In dry-run
+// mode the writes would only be simulated and then lost, so nothing is
+// replayed.
+func replayQueue() (replayed int, err error) {
+	if isDryRun() {
+		return 0, errors.New("Queued changes aren’t sent in dry-run mode")
+	}
+
+	var queue WriteQueue
+	var pending []PendingWrite
+	err = updateJson(queueFile, &queue, func() error {
+		pending = queue.Writes
+		queue.Writes = nil
+		return nil
+	})
+	if err != nil || len(pending) == 0 {
+		return
+	}
+
+	latest := map[string]time.Time{}
+	for _, w := range pending {
+		if w.Time.After(latest[w.Path]) {
+			latest[w.Path] = w.Time
+		}
+	}
+
+	var remaining []PendingWrite
+
+	for i, w := range pending {
+		if w.Time.Before(latest[w.Path]) {
+			log.Printf("Skipping superseded write: %s", w)
+			continue
+		}
+
+		if err := writeField(OriginQueue, w.Target, w.Field, w.Path, w.Value); err != nil {
+			if isNetworkError(err) {
+				remaining = append(remaining, pending[i:]...)
+				break
+			}
+			log.Printf("Dropping rejected write %s: %s", w, err)
+			continue
+		}
+
+		log.Printf("Replayed write: %s", w)
+		replayed++
+	}
+
+	if len(remaining) > 0 {
+		err = updateJson(queueFile, &queue, func() error {
+			queue.Writes = append(remaining, queue.Writes...)
+			return nil
+		})
+	}
+	return
+}
+
+// queue -------------------------------------------------
+
+type QueueCommand struct{}
+
+func (c QueueCommand) Keyword() string {
+	return "queue"
+}
+
+func (c QueueCommand) IsEnabled() bool {
+	return isAuthorized()
+}
+
+func (c QueueCommand) MenuItem() alfred.Item {
+	return alfred.NewKeywordItem(c.Keyword(), "", " ", "View changes waiting to be sent to Nest")
+}
+
+func (c QueueCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	queue, err := loadQueue()
+	if err != nil {
+		return
+	}
+
+	if len(queue.Writes) == 0 {
+		items = append(items, alfred.Item{
+			Title: tr("No pending changes"),
+			Valid: alfred.Invalid,
+		})
+		return
+	}
+
+	if alfred.FuzzyMatches("replay", query) {
+		items = append(items, alfred.Item{
+			Title:        "replay",
+			SubtitleAll:  tr("Send %d pending changes now", len(queue.Writes)),
+			Autocomplete: prefix + "replay",
+			Arg:          "queue replay",
+		})
+	}
+
+	if alfred.FuzzyMatches("clear", query) {
+		items = append(items, alfred.Item{
+			Title:        "clear",
+			SubtitleAll:  tr("Discard all pending changes"),
+			Autocomplete: prefix + "clear",
+			Arg:          "queue clear",
+		})
+	}
+
+	for i := len(queue.Writes) - 1; i >= 0; i-- {
+		w := queue.Writes[i]
+		items = append(items, alfred.Item{
+			Title:       fmt.Sprintf("%s: %s → %s", w.Name, w.Field, w.Value),
+			SubtitleAll: tr("Queued at %s", formatTime(w.Time, time.Local)),
+			Valid:       alfred.Invalid,
+		})
+	}
+
+	return
+}
+
+func (c QueueCommand) Do(query string) (out string, err error) {
+	switch query {
+	case "replay":
+		var replayed int
+		if replayed, err = replayQueue(); err != nil {
+			return
+		}
+		scheduleRefresh()
+		queue, _ := loadQueue()
+		out = markSimulated(tr("Sent %d changes, %d still pending", replayed, len(queue.Writes)))
+	case "clear":
+		var queue WriteQueue
+		err = updateJson(queueFile, &queue, func() error {
+			queue.Writes = nil
+			return nil
+		})
+		out = tr("Cleared pending changes")
+	default:
+		err = errors.New("Unknown queue command '" + query + "'")
+	}
+	return
+}
@@ -31,3 +31,9 @@ func (t RefreshCommand) Items(sync, query string) ([]alfred.Item, error) {
 		Valid: alfred.Invalid,
 	}}, nil
 }
+
+// Do refreshes the cache. It's used to refresh in the background when a
+// command finds stale data.
+func (t RefreshCommand) Do(query string) (string, error) {
+	return "", refresh()
+}
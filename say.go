@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/go-alfred"
+)
+
+type SayCommand struct{}
+
+func (c SayCommand) Keyword() string {
+	return "say"
+}
+
+func (c SayCommand) IsEnabled() bool {
+	return isAuthorized()
+}
+
+func (c SayCommand) MenuItem() alfred.Item {
+	return alfred.NewKeywordItem(c.Keyword(), "", " ",
+		"Describe a change, like “set upstairs to 70 and heat”")
+}
+
+// Items previews what a command would do. The first item carries the parsed
+// intent; the rest describe each part of it.
+func (c SayCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	if strings.TrimSpace(query) == "" {
+		return []alfred.Item{alfred.Item{
+			Title:       tr("Describe a change"),
+			SubtitleAll: tr("e.g. “cool bedroom 68 for 2 hours” or “away until monday”"),
+			Valid:       alfred.Invalid,
+		}}, nil
+	}
+
+	if err = checkRefresh(); err != nil {
+		return
+	}
+
+	// times like "6pm" are in the thermostat's time zone, which isn't known
+	// until the query has been parsed
+	intent, err := parseIntent(query, time.Now())
+	if err == nil {
+		intent, err = parseIntent(query, time.Now().In(thermostatLocation(intent.DeviceId)))
+	}
+	if err != nil {
+		return []alfred.Item{alfred.Item{
+			Title:       err.Error(),
+			SubtitleAll: tr("Try something like “heat upstairs to 70 until 6pm”"),
+			Valid:       alfred.Invalid,
+		}}, nil
+	}
+
+	thermostat, ok := cache.AllData.Devices.Thermostats[intent.DeviceId]
+	if !ok {
+		return items, errors.New("Couldn’t find a thermostat to change")
+	}
+
+	data, _ := json.Marshal(intent)
+	items = append(items, alfred.Item{
+		Title:       describeIntent(&intent, &thermostat),
+		SubtitleAll: tr("Press Enter to apply"),
+		Arg:         "say " + string(data),
+	})
+
+	for _, line := range describeIntentParts(&intent, &thermostat) {
+		items = append(items, alfred.Item{
+			Title: line,
+			Valid: alfred.Invalid,
+		})
+	}
+
+	return
+}
+
+func (c SayCommand) Do(query string) (string, error) {
+	var intent Intent
+	if err := json.Unmarshal([]byte(query), &intent); err != nil {
+		return "", err
+	}
+	return applyIntent(intent)
+}
+
+// describeIntent summarizes an intent in one line.
+func describeIntent(intent *Intent, thermostat *nest.Thermostat) string {
+	var parts []string
+	if intent.Presence != "" {
+		parts = append(parts, string(intent.Presence))
+	}
+	if intent.Mode != "" {
+		parts = append(parts, string(intent.Mode))
+	}
+	if intent.HasTemp {
+		parts = append(parts, formatTemp(intent.Temperature()))
+	}
+
+	summary := thermostat.Name + ": " + strings.Join(parts, ", ")
+	if !intent.Until.IsZero() {
+		summary += tr(" until %s", formatUntil(intent.Until, intent.DeviceId))
+	}
+	return summary
+}
+
+// describeIntentParts describes each change in an intent, with the current
+// value it will replace.
+func describeIntentParts(intent *Intent, thermostat *nest.Thermostat) (lines []string) {
+	structure := cache.AllData.Structures[thermostat.StructureId]
+
+	if intent.Presence != "" {
+		lines = append(lines, tr("Presence at %s: %s → %s", structure.Name, structure.Away, intent.Presence))
+	}
+	if intent.Mode != "" {
+		lines = append(lines, tr("Mode: %s → %s", thermostat.HvacMode, intent.Mode))
+	}
+	if intent.HasTemp {
+		mode := intent.Mode
+		if mode == "" {
+			mode = thermostat.HvacMode
+		}
+		hilo, err := chooseHiLo(thermostat, mode, intent.Temperature())
+		if err != nil {
+			lines = append(lines, err.Error())
+		} else {
+			lines = append(lines, fmt.Sprintf("%s: %s → %s", targetName(hilo),
+				formatTemp(currentTarget(thermostat, hilo, intent.Scale)), formatTemp(intent.Temperature())))
+		}
+	}
+	if !intent.Until.IsZero() {
+		lines = append(lines, tr("Then restore current settings at %s", formatUntil(intent.Until, intent.DeviceId)))
+	}
+	return
+}
+
+// formatUntil formats the time of a scheduled change in the time zone of the
+// thermostat it changes.
+func formatUntil(t time.Time, deviceId string) string {
+	return formatShortTime(t, thermostatLocation(deviceId))
+}
+
+func targetName(hilo nest.HighLow) string {
+	switch hilo {
+	case nest.TypeHigh:
+		return tr("High target")
+	case nest.TypeLow:
+		return tr("Low target")
+	}
+	return tr("Target")
+}
+
+func currentTarget(thermostat *nest.Thermostat, hilo nest.HighLow, scale nest.TempScale) nest.Temperature {
+	switch hilo {
+	case nest.TypeHigh:
+		return thermostat.TargetTemperatureHigh(scale)
+	case nest.TypeLow:
+		return thermostat.TargetTemperatureLow(scale)
+	}
+	return thermostat.TargetTemperature(scale)
+}
+
+// applyIntent makes the changes in an intent through the presence, mode and
+// temp commands, so they're journaled, queued and audited like any other
+// change. If the intent has an end time, the settings it changed are
+// scheduled to be restored then, even if a later change fails.
+func applyIntent(intent Intent) (out string, err error) {
+	thermostat, ok := cache.AllData.Devices.Thermostats[intent.DeviceId]
+	if !ok {
+		return out, errors.New("Unknown thermostat '" + intent.DeviceId + "'")
+	}
+	structure := cache.AllData.Structures[thermostat.StructureId]
+
+	revert := Intent{DeviceId: intent.DeviceId}
+	var outs []string
+
+	run := func(cmd func(string) (string, error), msg interface{}) error {
+		data, _ := json.Marshal(msg)
+		result, err := cmd(string(data))
+		if result != "" {
+			outs = append(outs, result)
+		}
+		return err
+	}
+
+	defer func() {
+		if intent.Until.IsZero() || revert.IsEmpty() {
+			return
+		}
+		description := tr("Restore %s", describeIntent(&revert, &thermostat))
+		if serr := scheduleIntent(intent.Until, revert, description); serr != nil {
+			log.Println("Error scheduling restore:", serr)
+			outs = append(outs, tr("couldn’t schedule restore"))
+		} else {
+			outs = append(outs, tr("restoring at %s", formatUntil(intent.Until, intent.DeviceId)))
+		}
+
+		if err != nil {
+			err = fmt.Errorf("%s (%s)", err, strings.Join(outs, "; "))
+		} else {
+			out = strings.Join(outs, "; ")
+		}
+	}()
+
+	if intent.Presence != "" {
+		msg := awayMessage{StructureId: structure.StructureId, Away: intent.Presence}
+		if err = run(PresenceCommand{}.Do, msg); err != nil {
+			return
+		}
+		revert.Presence = structure.Away
+	}
+
+	if intent.Mode != "" {
+		msg := modeMessage{DeviceId: intent.DeviceId, Mode: intent.Mode}
+		if err = run(ModeCommand{}.Do, msg); err != nil {
+			return
+		}
+		revert.Mode = thermostat.HvacMode
+	}
+
+	if intent.HasTemp {
+		mode := intent.Mode
+		if mode == "" {
+			mode = thermostat.HvacMode
+		}
+
+		hilo := intent.HiLo
+		if hilo == "" {
+			if hilo, err = chooseHiLo(&thermostat, mode, intent.Temperature()); err != nil {
+				return
+			}
+		}
+
+		msg := tempMessage{
+			DeviceId:   intent.DeviceId,
+			TargetTemp: intent.Temp,
+			Scale:      intent.Scale,
+			Mode:       mode,
+			HiLo:       hilo,
+		}
+		if err = run(TempCommand{}.Do, msg); err != nil {
+			return
+		}
+
+		if thermostat.HvacMode != nest.ModeOff {
+			revert.HasTemp = true
+			revert.Temp = currentTarget(&thermostat, hilo, intent.Scale).Value()
+			revert.Scale = intent.Scale
+			revert.HiLo = hilo
+		}
+	}
+
+	out = strings.Join(outs, "; ")
+	return
+}
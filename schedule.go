@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+const OriginScheduler = "scheduler"
+
+// maxSchedulerSleep limits how long the scheduler sleeps at once, so it picks
+// up actions scheduled by other processes.
+const maxSchedulerSleep = time.Minute
+
+// schedulerTimeout is how long after its last check-in a scheduler is
+// considered to have died.
+const schedulerTimeout = 3 * maxSchedulerSleep
+
+// ScheduledAction is an intent to be applied at a later time, such as
+// restoring settings at the end of "heat to 72 for 2 hours".
+type ScheduledAction struct {
+	Id          string
+	Due         time.Time
+	Intent      Intent
+	Description string
+}
+
+// Schedule holds the scheduled actions. Only one scheduler process runs at a
+// time: SchedulerPid is the process applying the actions, and SchedulerSeen
+// is when it last checked in, or when one was last started.
+type Schedule struct {
+	Actions       []ScheduledAction
+	SchedulerPid  int       `json:",omitempty"`
+	SchedulerSeen time.Time `json:",omitempty"`
+}
+
+// HasDueActions returns true if any action's time has come.
+func (s *Schedule) HasDueActions() bool {
+	now := time.Now()
+	for _, action := range s.Actions {
+		if !action.Due.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScheduler returns true if a scheduler has checked in or been started
+// recently.
+func (s *Schedule) hasScheduler() bool {
+	return time.Now().Sub(s.SchedulerSeen) < schedulerTimeout
+}
+
+func loadSchedule() (schedule Schedule, err error) {
+	err = loadJson(scheduleFile, &schedule)
+	return
+}
+
+// scheduleIntent saves an intent to be applied at a given time and starts a
+// scheduler process to apply it, unless one is already running.
+func scheduleIntent(due time.Time, intent Intent, description string) error {
+	return startScheduler(func(schedule *Schedule) {
+		schedule.Actions = append(schedule.Actions, ScheduledAction{
+			Id:          strconv.FormatInt(time.Now().UnixNano(), 36),
+			Due:         due,
+			Intent:      intent,
+			Description: description,
+		})
+	})
+}
+
+// startScheduler starts a scheduler process if there are actions to apply and
+// no scheduler is running. If update is given, it changes the schedule first.
+func startScheduler(update func(schedule *Schedule)) error {
+	start := false
+	var schedule Schedule
+	err := updateJson(scheduleFile, &schedule, func() error {
+		if update != nil {
+			update(&schedule)
+		}
+		if len(schedule.Actions) > 0 && !schedule.hasScheduler() {
+			schedule.SchedulerPid = 0
+			schedule.SchedulerSeen = time.Now()
+			start = true
+		}
+		return nil
+	})
+	if err != nil || !start {
+		return err
+	}
+
+	return exec.Command(os.Args[0], "do", "schedule").Start()
+}
+
+// takeDueActions removes the actions whose time has come from the schedule and
+// returns them, along with the time the next action is due, if any.
+func takeDueActions(update func(schedule *Schedule) error) (due []ScheduledAction, next time.Time, err error) {
+	var schedule Schedule
+	err = updateJson(scheduleFile, &schedule, func() error {
+		var remaining []ScheduledAction
+		now := time.Now()
+
+		for _, action := range schedule.Actions {
+			if action.Due.After(now) {
+				remaining = append(remaining, action)
+				if next.IsZero() || action.Due.Before(next) {
+					next = action.Due
+				}
+			} else {
+				due = append(due, action)
+			}
+		}
+
+		schedule.Actions = remaining
+		if update != nil {
+			return update(&schedule)
+		}
+		return nil
+	})
+	return
+}
+
+// runActions applies scheduled actions in order.
+func runActions(actions []ScheduledAction) {
+	for _, action := range actions {
+		// pick up changes made since the scheduler started
+		if err := loadJson(cacheFile, &cache); err != nil {
+			log.Println("Error loading cache:", err)
+		}
+
+		log.Printf("Running scheduled action: %s", action.Description)
+		if out, err := applyIntent(action.Intent); err != nil {
+			log.Printf("Error running scheduled action: %s", err)
+		} else {
+			log.Printf("Scheduled action result: %s", out)
+		}
+	}
+}
+
+// runScheduler applies actions as they come due, checking in with the
+// schedule each time it wakes up. It returns when no actions are left, or if
+// another scheduler has taken over.
+func runScheduler() error {
+	pid := os.Getpid()
+
+	for {
+		done := false
+		due, next, err := takeDueActions(func(schedule *Schedule) error {
+			if schedule.SchedulerPid != 0 && schedule.SchedulerPid != pid && schedule.hasScheduler() {
+				return errors.New("Another scheduler is running")
+			}
+
+			if len(schedule.Actions) == 0 {
+				// nothing left to wait for; let the next scheduleIntent start
+				// a new scheduler
+				schedule.SchedulerPid = 0
+				schedule.SchedulerSeen = time.Time{}
+				done = true
+			} else {
+				schedule.SchedulerPid = pid
+				schedule.SchedulerSeen = time.Now()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		runActions(due)
+		if done {
+			return nil
+		}
+
+		sleep := next.Sub(time.Now())
+		if sleep > maxSchedulerSleep {
+			sleep = maxSchedulerSleep
+		}
+		if sleep > 0 {
+			time.Sleep(sleep)
+		}
+	}
+}
+
+// schedule ----------------------------------------------
+
+type ScheduleCommand struct{}
+
+func (c ScheduleCommand) Keyword() string {
+	return "schedule"
+}
+
+func (c ScheduleCommand) IsEnabled() bool {
+	return isAuthorized()
+}
+
+func (c ScheduleCommand) MenuItem() alfred.Item {
+	return alfred.NewKeywordItem(c.Keyword(), "", " ", "View and cancel scheduled changes")
+}
+
+func (c ScheduleCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	schedule, err := loadSchedule()
+	if err != nil {
+		return
+	}
+
+	for _, action := range schedule.Actions {
+		if alfred.FuzzyMatches(action.Description, query) {
+			items = append(items, alfred.Item{
+				Title: action.Description,
+				SubtitleAll: fmt.Sprintf("At %s; press Enter to cancel", formatUntil(action.Due,
+					action.Intent.DeviceId)),
+				Arg: "schedule cancel " + action.Id,
+			})
+		}
+	}
+
+	if len(items) == 0 {
+		items = append(items, alfred.Item{
+			Title: "No scheduled changes",
+			Valid: alfred.Invalid,
+		})
+	}
+
+	return
+}
+
+// Do cancels a scheduled action when given "cancel <id>". Otherwise it runs
+// the scheduler, which applies actions as they come due and exits when none
+// are left or another scheduler is already running.
+func (c ScheduleCommand) Do(query string) (out string, err error) {
+	if len(query) > 7 && query[:7] == "cancel " {
+		id := query[7:]
+		var schedule Schedule
+		err = updateJson(scheduleFile, &schedule, func() error {
+			for i, action := range schedule.Actions {
+				if action.Id == id {
+					schedule.Actions = append(schedule.Actions[:i], schedule.Actions[i+1:]...)
+					out = tr("Cancelled: %s", action.Description)
+					return nil
+				}
+			}
+			return errors.New("Unknown scheduled action '" + id + "'")
+		})
+		return
+	}
+
+	writeOrigin = OriginScheduler
+	err = runScheduler()
+	return
+}
@@ -0,0 +1,464 @@
+// Package sdm is a thermostat backend for Google's Smart Device Management
+// API, which replaced the Works with Nest API. Devices are read from
+// enterprises/{project}/devices and changed with executeCommand; their
+// sdm.devices.traits.* traits are mapped onto nest.Thermostat.
+package sdm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// ApiHost is the root of the SDM API.
+const ApiHost = "https://smartdevicemanagement.googleapis.com/v1"
+
+const (
+	TypeThermostat = "sdm.devices.types.THERMOSTAT"
+
+	TraitInfo         = "sdm.devices.traits.Info"
+	TraitConnectivity = "sdm.devices.traits.Connectivity"
+	TraitHumidity     = "sdm.devices.traits.Humidity"
+	TraitTemperature  = "sdm.devices.traits.Temperature"
+	TraitSettings     = "sdm.devices.traits.Settings"
+	TraitFan          = "sdm.devices.traits.Fan"
+	TraitMode         = "sdm.devices.traits.ThermostatMode"
+	TraitEco          = "sdm.devices.traits.ThermostatEco"
+	TraitHvac         = "sdm.devices.traits.ThermostatHvac"
+	TraitSetpoint     = "sdm.devices.traits.ThermostatTemperatureSetpoint"
+
+	TraitStructureInfo = "sdm.structures.traits.Info"
+
+	CommandSetHeat  = "sdm.devices.commands.ThermostatTemperatureSetpoint.SetHeat"
+	CommandSetCool  = "sdm.devices.commands.ThermostatTemperatureSetpoint.SetCool"
+	CommandSetRange = "sdm.devices.commands.ThermostatTemperatureSetpoint.SetRange"
+	CommandSetMode  = "sdm.devices.commands.ThermostatMode.SetMode"
+	CommandSetTimer = "sdm.devices.commands.Fan.SetTimer"
+)
+
+// FanTimerDuration is how long the fan runs when its timer is turned on.
+const FanTimerDuration = 15 * time.Minute
+
+// Device is an SDM device resource.
+type Device struct {
+	Name            string                     `json:"name"`
+	Type            string                     `json:"type"`
+	Traits          map[string]json.RawMessage `json:"traits"`
+	ParentRelations []struct {
+		Parent      string `json:"parent"`
+		DisplayName string `json:"displayName"`
+	} `json:"parentRelations"`
+}
+
+// Structure is an SDM structure resource.
+type Structure struct {
+	Name   string                     `json:"name"`
+	Traits map[string]json.RawMessage `json:"traits"`
+}
+
+// Traits used by thermostats
+type (
+	InfoTrait struct {
+		CustomName string `json:"customName"`
+	}
+	ConnectivityTrait struct {
+		Status string `json:"status"`
+	}
+	HumidityTrait struct {
+		AmbientHumidityPercent float64 `json:"ambientHumidityPercent"`
+	}
+	TemperatureTrait struct {
+		AmbientTemperatureCelsius float64 `json:"ambientTemperatureCelsius"`
+	}
+	SettingsTrait struct {
+		TemperatureScale string `json:"temperatureScale"`
+	}
+	FanTrait struct {
+		TimerMode    string    `json:"timerMode"`
+		TimerTimeout time.Time `json:"timerTimeout"`
+	}
+	ModeTrait struct {
+		Mode           string   `json:"mode"`
+		AvailableModes []string `json:"availableModes"`
+	}
+	EcoTrait struct {
+		Mode        string  `json:"mode"`
+		HeatCelsius float64 `json:"heatCelsius"`
+		CoolCelsius float64 `json:"coolCelsius"`
+	}
+	HvacTrait struct {
+		Status string `json:"status"`
+	}
+	SetpointTrait struct {
+		HeatCelsius float64 `json:"heatCelsius"`
+		CoolCelsius float64 `json:"coolCelsius"`
+	}
+)
+
+// Trait decodes one of a device's traits into v. It returns false if the
+// device doesn't have the trait.
+func (d *Device) Trait(name string, v interface{}) bool {
+	data, ok := d.Traits[name]
+	return ok && json.Unmarshal(data, v) == nil
+}
+
+// Id returns the last element of the device's resource name.
+func (d *Device) Id() string {
+	return lastElement(d.Name)
+}
+
+// StructureId returns the ID of the structure the device is in.
+func (d *Device) StructureId() string {
+	for _, relation := range d.ParentRelations {
+		parts := strings.Split(relation.Parent, "/")
+		for i := 0; i < len(parts)-1; i++ {
+			if parts[i] == "structures" {
+				return parts[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// SDM modes and the equivalent Nest modes
+var modes = map[string]nest.HvacMode{
+	"HEAT":     nest.ModeHeat,
+	"COOL":     nest.ModeCool,
+	"HEATCOOL": nest.ModeRange,
+	"OFF":      nest.ModeOff,
+}
+
+func sdmMode(mode nest.HvacMode) (string, bool) {
+	for sdm, m := range modes {
+		if m == mode {
+			return sdm, true
+		}
+	}
+	return "", false
+}
+
+// Thermostat maps a device's traits onto a nest.Thermostat. Eco temperatures
+// become the away temperatures, since eco mode replaced away mode.
+func (d *Device) Thermostat() nest.Thermostat {
+	t := nest.Thermostat{
+		DeviceId:         d.Id(),
+		StructureId:      d.StructureId(),
+		TemperatureScale: nest.ScaleC,
+	}
+
+	var info InfoTrait
+	d.Trait(TraitInfo, &info)
+	t.Name = info.CustomName
+	if t.Name == "" && len(d.ParentRelations) > 0 {
+		t.Name = d.ParentRelations[0].DisplayName
+	}
+	t.NameLong = t.Name
+
+	var connectivity ConnectivityTrait
+	if d.Trait(TraitConnectivity, &connectivity) {
+		t.IsOnline = connectivity.Status == "ONLINE"
+		if t.IsOnline {
+			t.LastConnection = time.Now()
+		}
+	}
+
+	var humidity HumidityTrait
+	if d.Trait(TraitHumidity, &humidity) {
+		t.Humidity = nest.Humidity(humidity.AmbientHumidityPercent)
+	}
+
+	var settings SettingsTrait
+	if d.Trait(TraitSettings, &settings) && settings.TemperatureScale == "FAHRENHEIT" {
+		t.TemperatureScale = nest.ScaleF
+	}
+
+	var fan FanTrait
+	if d.Trait(TraitFan, &fan) {
+		t.HasFan = true
+		t.FanTimerActive = fan.TimerMode == "ON"
+		t.FanTimerTimeout = fan.TimerTimeout
+	}
+
+	var mode ModeTrait
+	d.Trait(TraitMode, &mode)
+	t.HvacMode = modes[mode.Mode]
+	for _, m := range mode.AvailableModes {
+		switch m {
+		case "HEAT":
+			t.CanHeat = true
+		case "COOL":
+			t.CanCool = true
+		}
+	}
+
+	var ambient TemperatureTrait
+	if d.Trait(TraitTemperature, &ambient) {
+		t.AmbientTemperatureF, t.AmbientTemperatureC = both(ambient.AmbientTemperatureCelsius)
+	}
+
+	var setpoint SetpointTrait
+	if d.Trait(TraitSetpoint, &setpoint) {
+		switch t.HvacMode {
+		case nest.ModeHeat:
+			t.TargetTemperatureF, t.TargetTemperatureC = both(setpoint.HeatCelsius)
+		case nest.ModeCool:
+			t.TargetTemperatureF, t.TargetTemperatureC = both(setpoint.CoolCelsius)
+		case nest.ModeRange:
+			t.TargetTemperatureLowF, t.TargetTemperatureLowC = both(setpoint.HeatCelsius)
+			t.TargetTemperatureHighF, t.TargetTemperatureHighC = both(setpoint.CoolCelsius)
+		}
+	}
+
+	var eco EcoTrait
+	if d.Trait(TraitEco, &eco) {
+		t.AwayTemperatureLowF, t.AwayTemperatureLowC = both(eco.HeatCelsius)
+		t.AwayTemperatureHighF, t.AwayTemperatureHighC = both(eco.CoolCelsius)
+	}
+
+	return t
+}
+
+// both returns a Celsius temperature in both scales.
+func both(celsius float64) (nest.TempF, nest.TempC) {
+	f := nest.ConvertTemp(nest.TempC(celsius), nest.ScaleF)
+	return f.(nest.TempF), nest.TempC(celsius)
+}
+
+func lastElement(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// Session makes requests to the SDM API for a Device Access project.
+type Session struct {
+	// Host is the API root, ApiHost unless a stand-in server is used.
+	Host string
+
+	// OnRequest, if set, is called after every HTTP request to the API with
+	// the request method and any error.
+	OnRequest func(method string, err error)
+
+	project string
+	token   string
+}
+
+var _ nest.ThermostatBackend = &Session{}
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// OpenSession returns a session for a Device Access project ID that
+// authenticates with an OAuth access token.
+func OpenSession(project, token string) *Session {
+	return &Session{Host: ApiHost, project: project, token: token}
+}
+
+func (s *Session) enterprise() string {
+	return "/enterprises/" + s.project
+}
+
+func (s *Session) requested(method string, err error) {
+	if s.OnRequest != nil {
+		s.OnRequest(method, err)
+	}
+}
+
+func (s *Session) request(method, path string, body, v interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, s.Host+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		s.requested(method, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode >= 400 {
+		err = errors.New(resp.Status)
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(content, &apiErr) == nil && apiErr.Error.Message != "" {
+			err = fmt.Errorf("%s: %s", resp.Status, apiErr.Error.Message)
+		}
+	}
+	s.requested(method, err)
+	if err != nil {
+		return err
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(content, v)
+}
+
+// GetDevices lists the project's devices of every type.
+func (s *Session) GetDevices() (devices []Device, err error) {
+	var resp struct {
+		Devices []Device `json:"devices"`
+	}
+	err = s.request("GET", s.enterprise()+"/devices", nil, &resp)
+	return resp.Devices, err
+}
+
+// GetDevice reads one device.
+func (s *Session) GetDevice(id string) (device Device, err error) {
+	err = s.request("GET", s.enterprise()+"/devices/"+id, nil, &device)
+	return
+}
+
+// GetStructures lists the project's structures.
+func (s *Session) GetStructures() (structures []Structure, err error) {
+	var resp struct {
+		Structures []Structure `json:"structures"`
+	}
+	err = s.request("GET", s.enterprise()+"/structures", nil, &resp)
+	return resp.Structures, err
+}
+
+// ExecuteCommand runs a command on a device.
+func (s *Session) ExecuteCommand(id, command string, params interface{}) error {
+	body := map[string]interface{}{"command": command, "params": params}
+	return s.request("POST", s.enterprise()+"/devices/"+id+":executeCommand", body, nil)
+}
+
+// GetAllData reads every thermostat and the structures they're in. SDM
+// doesn't expose presence, so every structure is reported as home.
+func (s *Session) GetAllData() (data nest.AllData, err error) {
+	thermostats, err := s.GetThermostats()
+	if err != nil {
+		return
+	}
+	structures, err := s.GetStructures()
+	if err != nil {
+		return
+	}
+
+	data.Structures = map[string]nest.Structure{}
+	for _, st := range structures {
+		var info InfoTrait
+		if raw, ok := st.Traits[TraitStructureInfo]; ok {
+			json.Unmarshal(raw, &info)
+		}
+		id := lastElement(st.Name)
+		data.Structures[id] = nest.Structure{StructureId: id, Name: info.CustomName, Away: nest.Home}
+	}
+
+	data.Devices.Thermostats = map[string]nest.Thermostat{}
+	for _, t := range thermostats {
+		data.Devices.Thermostats[t.DeviceId] = t
+		if st, ok := data.Structures[t.StructureId]; ok {
+			st.Thermostats = append(st.Thermostats, t.DeviceId)
+			data.Structures[t.StructureId] = st
+		}
+	}
+	return
+}
+
+// GetThermostats lists the project's thermostats.
+func (s *Session) GetThermostats() (thermostats []nest.Thermostat, err error) {
+	devices, err := s.GetDevices()
+	if err != nil {
+		return
+	}
+	for _, d := range devices {
+		if d.Type == TypeThermostat {
+			thermostats = append(thermostats, d.Thermostat())
+		}
+	}
+	return
+}
+
+// SetTargetTemp sets the setpoint for the thermostat's current mode. SDM only
+// sets heat-cool targets as a pair, so the other target is read from the
+// device.
+func (s *Session) SetTargetTemp(id string, temp nest.Temperature, hilo nest.HighLow) (nest.Temperature, error) {
+	device, err := s.GetDevice(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var mode ModeTrait
+	var setpoint SetpointTrait
+	device.Trait(TraitMode, &mode)
+	device.Trait(TraitSetpoint, &setpoint)
+
+	celsius := nest.ConvertTemp(temp, nest.ScaleC).Value()
+	switch modes[mode.Mode] {
+	case nest.ModeHeat:
+		err = s.ExecuteCommand(id, CommandSetHeat, map[string]float64{"heatCelsius": celsius})
+	case nest.ModeCool:
+		err = s.ExecuteCommand(id, CommandSetCool, map[string]float64{"coolCelsius": celsius})
+	case nest.ModeRange:
+		switch hilo {
+		case nest.TypeLow:
+			setpoint.HeatCelsius = celsius
+		case nest.TypeHigh:
+			setpoint.CoolCelsius = celsius
+		default:
+			return nil, errors.New("Choose the high or low target in heat-cool mode")
+		}
+		err = s.ExecuteCommand(id, CommandSetRange, setpoint)
+	default:
+		return nil, errors.New("Can’t set a target temperature while the thermostat is " +
+			strings.ToLower(mode.Mode))
+	}
+
+	return temp, err
+}
+
+// SetTargetRange sets both heat-cool targets.
+func (s *Session) SetTargetRange(id string, low, high nest.Temperature) error {
+	return s.ExecuteCommand(id, CommandSetRange, SetpointTrait{
+		HeatCelsius: nest.ConvertTemp(low, nest.ScaleC).Value(),
+		CoolCelsius: nest.ConvertTemp(high, nest.ScaleC).Value(),
+	})
+}
+
+// SetHvacMode sets a thermostat's mode.
+func (s *Session) SetHvacMode(id string, mode nest.HvacMode) error {
+	m, ok := sdmMode(mode)
+	if !ok {
+		return errors.New("Invalid HVAC mode '" + string(mode) + "'")
+	}
+	return s.ExecuteCommand(id, CommandSetMode, map[string]string{"mode": m})
+}
+
+// SetPresence isn't supported; SDM has no equivalent of Nest's away setting.
+func (s *Session) SetPresence(structureId string, presence nest.Presence) error {
+	return errors.New("The Smart Device Management API can’t change presence")
+}
+
+// SetFanTimer runs the fan for FanTimerDuration, or turns it off.
+func (s *Session) SetFanTimer(id string, on bool) error {
+	params := map[string]string{"timerMode": "OFF"}
+	if on {
+		params["timerMode"] = "ON"
+		params["duration"] = fmt.Sprintf("%ds", int(FanTimerDuration.Seconds()))
+	}
+	return s.ExecuteCommand(id, CommandSetTimer, params)
+}
@@ -0,0 +1,275 @@
+package sdm_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jason0x43/alfred-nest/internal/sdmfake"
+	"github.com/jason0x43/alfred-nest/nest"
+	"github.com/jason0x43/alfred-nest/sdm"
+)
+
+const (
+	project  = "test-project"
+	deviceId = "living-room"
+)
+
+// newTestSession returns a session connected to a stand-in server with one
+// thermostat, in heat mode at 21°C.
+func newTestSession(t *testing.T) *sdm.Session {
+	fake := sdmfake.NewServer(project)
+	fake.Token = "token"
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	session := sdm.OpenSession(project, "token")
+	session.Host = server.URL
+	return session
+}
+
+func thermostat(t *testing.T, session *sdm.Session) nest.Thermostat {
+	data, err := session.GetAllData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	thermostat, ok := data.Devices.Thermostats[deviceId]
+	if !ok {
+		t.Fatalf("no thermostat %s in %+v", deviceId, data.Devices.Thermostats)
+	}
+	return thermostat
+}
+
+func TestGetAllData(t *testing.T) {
+	session := newTestSession(t)
+	data, err := session.GetAllData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	structure, ok := data.Structures["home"]
+	if !ok {
+		t.Fatalf("no structure in %+v", data.Structures)
+	}
+	if structure.Name != "Home" || structure.Away != nest.Home {
+		t.Errorf("got structure %+v, want Home, at home", structure)
+	}
+	if len(structure.Thermostats) != 1 || structure.Thermostats[0] != deviceId {
+		t.Errorf("structure thermostats are %v, want [%s]", structure.Thermostats, deviceId)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"Name", data.Devices.Thermostats[deviceId].Name, "Living Room"},
+		{"StructureId", data.Devices.Thermostats[deviceId].StructureId, "home"},
+		{"IsOnline", data.Devices.Thermostats[deviceId].IsOnline, true},
+		{"HvacMode", data.Devices.Thermostats[deviceId].HvacMode, nest.ModeHeat},
+		{"Humidity", data.Devices.Thermostats[deviceId].Humidity, nest.Humidity(42)},
+		{"AmbientTemperatureC", data.Devices.Thermostats[deviceId].AmbientTemperatureC, nest.TempC(20.5)},
+		{"AmbientTemperatureF", data.Devices.Thermostats[deviceId].AmbientTemperatureF, nest.TempF(68.9)},
+		{"TargetTemperatureC", data.Devices.Thermostats[deviceId].TargetTemperatureC, nest.TempC(21)},
+		{"AwayTemperatureLowC", data.Devices.Thermostats[deviceId].AwayTemperatureLowC, nest.TempC(15.5)},
+		{"CanCool", data.Devices.Thermostats[deviceId].CanCool, true},
+		{"HasFan", data.Devices.Thermostats[deviceId].HasFan, true},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s = %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestSetTargetTemp(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  nest.HvacMode
+		temp  nest.Temperature
+		hilo  nest.HighLow
+		check func(t nest.Thermostat) nest.Temperature
+		want  nest.Temperature
+	}{
+		{
+			name:  "heat",
+			mode:  nest.ModeHeat,
+			temp:  nest.TempC(22.5),
+			check: func(t nest.Thermostat) nest.Temperature { return t.TargetTemperatureC },
+			want:  nest.TempC(22.5),
+		},
+		{
+			name:  "heat in Fahrenheit",
+			mode:  nest.ModeHeat,
+			temp:  nest.TempF(70),
+			check: func(t nest.Thermostat) nest.Temperature { return t.TargetTemperatureC },
+			want:  nest.TempC(21.1),
+		},
+		{
+			name:  "cool",
+			mode:  nest.ModeCool,
+			temp:  nest.TempC(25),
+			check: func(t nest.Thermostat) nest.Temperature { return t.TargetTemperatureC },
+			want:  nest.TempC(25),
+		},
+		{
+			name:  "heat-cool low",
+			mode:  nest.ModeRange,
+			temp:  nest.TempC(19),
+			hilo:  nest.TypeLow,
+			check: func(t nest.Thermostat) nest.Temperature { return t.TargetTemperatureLowC },
+			want:  nest.TempC(19),
+		},
+		{
+			name:  "heat-cool high",
+			mode:  nest.ModeRange,
+			temp:  nest.TempC(26),
+			hilo:  nest.TypeHigh,
+			check: func(t nest.Thermostat) nest.Temperature { return t.TargetTemperatureHighC },
+			want:  nest.TempC(26),
+		},
+	}
+
+	for _, test := range tests {
+		session := newTestSession(t)
+		if err := session.SetHvacMode(deviceId, test.mode); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if _, err := session.SetTargetTemp(deviceId, test.temp, test.hilo); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := test.check(thermostat(t, session)); got != test.want {
+			t.Errorf("%s: target is %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSetTargetRange(t *testing.T) {
+	session := newTestSession(t)
+	if err := session.SetHvacMode(deviceId, nest.ModeRange); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.SetTargetRange(deviceId, nest.TempC(19), nest.TempC(24)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := thermostat(t, session)
+	if got.TargetTemperatureLowC != 19 || got.TargetTemperatureHighC != 24 {
+		t.Errorf("range is %s to %s, want 19°C to 24°C", got.TargetTemperatureLowC,
+			got.TargetTemperatureHighC)
+	}
+}
+
+func TestSetFanTimer(t *testing.T) {
+	session := newTestSession(t)
+	for _, on := range []bool{true, false} {
+		if err := session.SetFanTimer(deviceId, on); err != nil {
+			t.Fatal(err)
+		}
+		if got := thermostat(t, session).FanTimerActive; got != on {
+			t.Errorf("FanTimerActive = %v, want %v", got, on)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		call    func(s *sdm.Session) error
+		message string
+	}{
+		{
+			name: "target while off",
+			call: func(s *sdm.Session) error {
+				if err := s.SetHvacMode(deviceId, nest.ModeOff); err != nil {
+					return err
+				}
+				_, err := s.SetTargetTemp(deviceId, nest.TempC(20), "")
+				return err
+			},
+			message: "while the thermostat is off",
+		},
+		{
+			name: "range too narrow",
+			call: func(s *sdm.Session) error {
+				if err := s.SetHvacMode(deviceId, nest.ModeRange); err != nil {
+					return err
+				}
+				return s.SetTargetRange(deviceId, nest.TempC(20), nest.TempC(21))
+			},
+			message: "400 Bad Request: Cool setpoint must be at least 1.5° above heat setpoint",
+		},
+		{
+			name: "range in heat mode",
+			call: func(s *sdm.Session) error {
+				return s.SetTargetRange(deviceId, nest.TempC(19), nest.TempC(24))
+			},
+			message: "SetRange requires HEATCOOL mode",
+		},
+		{
+			name: "invalid mode",
+			call: func(s *sdm.Session) error {
+				return s.SetHvacMode(deviceId, "eco")
+			},
+			message: "Invalid HVAC mode 'eco'",
+		},
+		{
+			name: "unknown device",
+			call: func(s *sdm.Session) error {
+				return s.SetHvacMode("kitchen", nest.ModeCool)
+			},
+			message: "404 Not Found: Device kitchen not found",
+		},
+		{
+			name: "presence",
+			call: func(s *sdm.Session) error {
+				return s.SetPresence("home", nest.Away)
+			},
+			message: "can’t change presence",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.call(newTestSession(t))
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+		} else if !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: got error %q, want %q", test.name, err, test.message)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	session := newTestSession(t)
+	wrong := sdm.OpenSession(project, "wrong")
+	wrong.Host = session.Host
+
+	_, err := wrong.GetAllData()
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got error %v, want 401 Unauthorized", err)
+	}
+}
+
+func TestOnRequest(t *testing.T) {
+	session := newTestSession(t)
+	var requests []string
+	session.OnRequest = func(method string, err error) {
+		if err != nil {
+			method += " failed"
+		}
+		requests = append(requests, method)
+	}
+
+	// devices and structures are read separately
+	if _, err := session.GetAllData(); err != nil {
+		t.Fatal(err)
+	}
+	session.SetHvacMode("kitchen", nest.ModeCool)
+
+	want := []string{"GET", "GET", "POST failed"}
+	if strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("OnRequest got %v, want %v", requests, want)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/jason0x43/go-alfred"
+)
+
+// OauthSettings are the OAuth client and endpoints used to authorize the
+// workflow.
+type OauthSettings struct {
+	ClientId     string
+	ClientSecret string
+	RedirectUri  string
+	AuthUrl      string
+	TokenUrl     string
+	Scope        string
+}
+
+// oauthField is a setting that can be given by an environment variable, the
+// config, or the setup command, in that order of precedence, and otherwise
+// has a built-in default.
+type oauthField struct {
+	Name   string
+	Title  string
+	Env    string
+	Secret bool
+	def    func() string
+	value  func(c *Config) *string
+	result func(s *OauthSettings) *string
+}
+
+func constant(value string) func() string {
+	return func() string { return value }
+}
+
+// oauthFields are listed in the order the setup command walks through them.
+var oauthFields = []oauthField{
+	{"client-id", "Client ID", "NEST_CLIENT_ID", false, constant(DefaultClientId),
+		func(c *Config) *string { return &c.ClientId },
+		func(s *OauthSettings) *string { return &s.ClientId }},
+	// the default secret is the one built in by oauthgen, if any
+	{"client-secret", "Client secret", "NEST_CLIENT_SECRET", true, func() string { return ClientSecret },
+		func(c *Config) *string { return &c.ClientSecret },
+		func(s *OauthSettings) *string { return &s.ClientSecret }},
+	{"redirect-uri", "Redirect URI", "NEST_REDIRECT_URI", false, constant(DefaultRedirectUri),
+		func(c *Config) *string { return &c.RedirectUri },
+		func(s *OauthSettings) *string { return &s.RedirectUri }},
+	{"auth-url", "Authorization URL", "NEST_AUTH_URL", false, constant(DefaultAuthUrl),
+		func(c *Config) *string { return &c.AuthUrl },
+		func(s *OauthSettings) *string { return &s.AuthUrl }},
+	{"token-url", "Token URL", "NEST_TOKEN_URL", false, constant(DefaultTokenUrl),
+		func(c *Config) *string { return &c.TokenUrl },
+		func(s *OauthSettings) *string { return &s.TokenUrl }},
+	{"scope", "Scope", "NEST_OAUTH_SCOPE", false, constant(""),
+		func(c *Config) *string { return &c.OauthScope },
+		func(s *OauthSettings) *string { return &s.Scope }},
+}
+
+// get returns a field's value and where it came from.
+func (f *oauthField) get() (value, source string) {
+	if value = os.Getenv(f.Env); value != "" {
+		return value, f.Env
+	}
+	if value = *f.value(&config); value != "" {
+		return value, "config"
+	}
+	return f.def(), "default"
+}
+
+// noun returns a field's title for use within a sentence.
+func (f *oauthField) noun() string {
+	return tr(strings.ToLower(f.Title))
+}
+
+// display returns a field's value for showing in items, masking secrets.
+func (f *oauthField) display(value string) string {
+	if value == "" {
+		return tr("(none)")
+	}
+	if f.Secret {
+		return strings.Repeat("•", 8)
+	}
+	return value
+}
+
+// oauthSettings resolves the OAuth settings from the environment, config and
+// defaults.
+func oauthSettings() (settings OauthSettings) {
+	for i := range oauthFields {
+		*oauthFields[i].result(&settings), _ = oauthFields[i].get()
+	}
+	return
+}
+
+// isCustomized returns true if any OAuth setting is set in the environment or
+// config.
+func isCustomized() bool {
+	for i := range oauthFields {
+		if _, source := oauthFields[i].get(); source != "default" {
+			return true
+		}
+	}
+	return false
+}
+
+// needsSetup returns true if the workflow hasn't been authorized and has no
+// usable OAuth client: nothing is configured and no secret was built in.
+func needsSetup() bool {
+	return config.AccessToken == "" && usesAccessToken(config.BackendUrl) && !isCustomized() &&
+		ClientSecret == ""
+}
+
+// callbackAddress returns the address and path the callback server should
+// listen on for a redirect URI, which must point to this machine.
+func callbackAddress(redirectUri string) (addr, path string, err error) {
+	u, err := url.Parse(redirectUri)
+	if err != nil {
+		return
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", "", fmt.Errorf("Redirect URI %s doesn’t point to this machine", redirectUri)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	path = u.Path
+	if path == "" {
+		path = "/"
+	}
+	return ":" + port, path, nil
+}
+
+// setup -------------------------------------------------
+
+type SetupCommand struct{}
+
+func (c SetupCommand) Keyword() string {
+	return "setup"
+}
+
+func (c SetupCommand) IsEnabled() bool {
+	return true
+}
+
+// MenuItem is the first-run item when the workflow can't authorize yet.
+func (c SetupCommand) MenuItem() alfred.Item {
+	if needsSetup() {
+		return alfred.Item{
+			Title:        tr("Set up authorization"),
+			SubtitleAll:  tr("Enter the OAuth client ID and secret for your Nest or Google developer account"),
+			Autocomplete: c.Keyword() + " ",
+			Valid:        alfred.Invalid,
+		}
+	}
+	return alfred.NewKeywordItem(c.Keyword(), "", " ", "Configure the OAuth client and endpoints")
+}
+
+// Items lists each setting with its current value and source, or for a
+// setting followed by a value, an item that saves it. Until the workflow is
+// authorized, the settings are numbered as steps.
+func (c SetupCommand) Items(prefix, query string) (items []alfred.Item, err error) {
+	parts := alfred.TrimAllLeft(strings.SplitN(query, " ", 2))
+	steps := config.AccessToken == "" && usesAccessToken(config.BackendUrl)
+
+	if len(parts) == 1 {
+		for i := range oauthFields {
+			f := &oauthFields[i]
+			if !alfred.FuzzyMatches(f.Name, parts[0]) {
+				continue
+			}
+
+			value, source := f.get()
+			title := tr(f.Title)
+			if steps {
+				title = tr("Step %d of %d: %s", i+1, len(oauthFields), tr(f.Title))
+			}
+			items = append(items, alfred.Item{
+				Title:        title,
+				SubtitleAll:  fmt.Sprintf("%s (%s)", f.display(value), tr(source)),
+				Autocomplete: prefix + f.Name + " ",
+				Valid:        alfred.Invalid,
+			})
+		}
+		return
+	}
+
+	var field *oauthField
+	for i := range oauthFields {
+		if oauthFields[i].Name == parts[0] {
+			field = &oauthFields[i]
+		}
+	}
+	if field == nil {
+		return []alfred.Item{alfred.Item{
+			Title: tr("Unknown setting '%s'", parts[0]),
+			Valid: alfred.Invalid,
+		}}, nil
+	}
+
+	value, source := field.get()
+	subtitle := tr("Currently %s (%s)", field.display(value), tr(source))
+	if source == field.Env {
+		subtitle += tr("; the environment variable takes precedence")
+	}
+
+	data, _ := json.Marshal(setupMessage{Field: field.Name, Value: parts[1]})
+	title := tr("Set %s to %s", field.noun(), field.display(parts[1]))
+	if parts[1] == "" {
+		title = tr("Reset %s to the default", field.noun())
+	}
+	items = append(items, alfred.Item{
+		Title:       title,
+		SubtitleAll: subtitle,
+		Arg:         "setup " + string(data),
+	})
+	return
+}
+
+// Do saves a setting. While the workflow is being set up, the output names the
+// next step.
+func (c SetupCommand) Do(query string) (out string, err error) {
+	var msg setupMessage
+	if err = json.Unmarshal([]byte(query), &msg); err != nil {
+		return
+	}
+
+	index := -1
+	for i := range oauthFields {
+		if oauthFields[i].Name == msg.Field {
+			index = i
+		}
+	}
+	if index < 0 {
+		return "", fmt.Errorf("Unknown setting '%s'", msg.Field)
+	}
+	field := &oauthFields[index]
+
+	if err = updateConfig(func(c *Config) error {
+		*field.value(c) = strings.TrimSpace(msg.Value)
+		return nil
+	}); err != nil {
+		return
+	}
+
+	out = tr("Saved %s", field.noun())
+	if msg.Value == "" {
+		out = tr("Reset %s", field.noun())
+	}
+	if config.AccessToken == "" && index+1 < len(oauthFields) {
+		out += tr("; next, %s", oauthFields[index+1].noun())
+	} else if config.AccessToken == "" {
+		out += tr("; now run authorize")
+	}
+	return
+}
+
+type setupMessage struct {
+	Field string
+	Value string
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/jason0x43/alfred-nest/nest"
 	"github.com/jason0x43/go-alfred"
 )
 
@@ -19,14 +22,14 @@ func (t StatusCommand) IsEnabled() bool {
 func (t StatusCommand) MenuItem() alfred.Item {
 	if config.NestId == "" {
 		return alfred.Item{
-			Title:        "Select a default Nest",
+			Title:        tr("Select a default Nest"),
 			Autocomplete: "config nest" + alfred.Separator + " ",
 			Valid:        alfred.Invalid,
 		}
 	} else {
 		if err := checkRefresh(); err != nil {
 			return alfred.Item{
-				Title:       "Error communicating with Nest",
+				Title:       tr("Error communicating with Nest"),
 				SubtitleAll: fmt.Sprintf("%v", err),
 				Valid:       alfred.Invalid,
 			}
@@ -34,17 +37,114 @@ func (t StatusCommand) MenuItem() alfred.Item {
 			thermostat, _ := cache.AllData.Devices.Thermostats[config.NestId]
 			structure, _ := cache.AllData.Structures[thermostat.StructureId]
 			return alfred.Item{
-				Title: thermostat.Name,
-				SubtitleAll: fmt.Sprintf("Temp: %v, Humidity: %v, Mode: %v, Presence: %v",
-					thermostat.AmbientTemperature(config.Scale), thermostat.Humidity, thermostat.HvacMode,
-					structure.Away),
-				Valid: alfred.Invalid,
+				Title:       thermostat.Name,
+				SubtitleAll: withCacheNote(statusSummary(&thermostat, &structure, cache.Weather, config.Scale)),
+				Valid:       alfred.Invalid,
+				Icon:        thermostatIcon(&thermostat, &structure),
 			}
 		}
 	}
 }
 
+// Items shows the status of the default Nest, followed by warnings for any
+// thermostat that's been using emergency heat for too long. If there are other
+// profiles, the status of every thermostat in each of them is listed after
+// that.
 func (t StatusCommand) Items(prefix, query string) (items []alfred.Item, err error) {
 	items = append(items, t.MenuItem())
+
+	for _, thermostat := range findThermostats("", true) {
+		if duration, ok := emergencyHeatDuration(thermostat.DeviceId); ok && duration >= emergencyHeatLimit() {
+			if item, ok := getEmergencyHeatItem(&thermostat); ok {
+				items = append(items, item)
+			}
+		}
+	}
+
+	for _, name := range listProfiles() {
+		if name != profile {
+			items = append(items, getProfileStatusItems(name)...)
+		}
+	}
+
+	return
+}
+
+// statusSummary describes a thermostat's state. Outdoor conditions are
+// included if weather is non-nil.
+func statusSummary(thermostat *nest.Thermostat, structure *nest.Structure, weather *Weather, scale nest.TempScale) string {
+	summary := tr("Temp: %s, Humidity: %s, Mode: %s, Presence: %s",
+		formatTemp(thermostat.AmbientTemperature(scale)), formatHumidity(thermostat.Humidity),
+		thermostat.HvacMode, structure.Away)
+	if weather != nil {
+		summary += ", " + outdoorSummary(weather, scale)
+	}
+	if thermostat.Humidity > 0 {
+		summary += ", " + comfortSummary(thermostat, scale)
+	}
+	if thermostat.IsUsingEmergencyHeat {
+		summary += ", " + tr("Emergency heat")
+	}
+	return summary
+}
+
+// getProfileStatusItems returns status items for the thermostats in an
+// inactive profile, using its cached data. If the cache is stale, a refresh is
+// started for the next time.
+func getProfileStatusItems(name string) (items []alfred.Item) {
+	profileConfig, profileCache, err := loadProfile(name)
+	if err != nil {
+		return []alfred.Item{alfred.Item{
+			Title:       name,
+			SubtitleAll: tr("Error loading profile: %s", err),
+			Valid:       alfred.Invalid,
+		}}
+	}
+
+	if !hasAuthorization(&profileConfig) {
+		return []alfred.Item{alfred.Item{
+			Title:       name,
+			SubtitleAll: tr("Not authorized"),
+			Valid:       alfred.Invalid,
+		}}
+	}
+
+	ttl := time.Duration(profileConfig.CacheTtl) * time.Minute
+	if ttl <= 0 {
+		ttl = DefaultCacheTtl * time.Minute
+	}
+	if profileCache.Expired || time.Now().Sub(profileCache.Time) >= ttl {
+		refreshProfileInBackground(name)
+	}
+
+	var ids []string
+	for id := range profileCache.AllData.Devices.Thermostats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		thermostat := profileCache.AllData.Devices.Thermostats[id]
+		structure := profileCache.AllData.Structures[thermostat.StructureId]
+		subtitle := statusSummary(&thermostat, &structure, profileCache.Weather, profileConfig.Scale)
+		if profileCache.LastError != "" {
+			subtitle = OfflineMarker + " " + subtitle
+		}
+		items = append(items, alfred.Item{
+			Title:       fmt.Sprintf("%s: %s", name, thermostat.Name),
+			SubtitleAll: subtitle,
+			Valid:       alfred.Invalid,
+			Icon:        thermostatIcon(&thermostat, &structure),
+		})
+	}
+
+	if len(items) == 0 {
+		items = append(items, alfred.Item{
+			Title:       name,
+			SubtitleAll: tr("No data yet"),
+			Valid:       alfred.Invalid,
+		})
+	}
+
 	return
 }
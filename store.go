@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+)
+
+// Alfred starts a new process for every keystroke, so several instances of
+// the workflow may be reading and writing the config and cache files at once.
+// Writes go through updateConfig and updateCache, which hold an exclusive lock
+// on the file while re-reading it, applying a change, and atomically replacing
+// it.
+
+// lockFile takes an exclusive advisory lock on a companion ".lock" file for
+// path, blocking until it's available. The returned function releases it.
+func lockFile(path string) (unlock func(), err error) {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return
+	}
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// loadJson decodes a JSON file into v. A missing file is not an error. Files
+// are only ever replaced by rename, so reads don't need to be locked.
+//
+// Config and cache files are migrated from older versions as they're read. If
+// one of them can't be decoded, it's backed up and v is left empty so the
+// workflow can start over rather than fail on every invocation. A file written
+// by a newer version of the workflow is left alone and an error is returned,
+// so it isn't overwritten either.
+func loadJson(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	migrations := migrationsFor(v)
+	if migrations == nil {
+		return json.Unmarshal(data, v)
+	}
+
+	err = decodeVersioned(data, v, migrations)
+	if _, ok := err.(newerVersionError); ok {
+		return fmt.Errorf("Can’t read %s: %s", path, err)
+	}
+	if err != nil {
+		backup, backupErr := backupFile(path)
+		if backupErr != nil {
+			return fmt.Errorf("%s (backup failed: %s)", err, backupErr)
+		}
+		log.Printf("Unable to read %s, moved it to %s: %s", path, backup, err)
+		reflect.ValueOf(v).Elem().Set(reflect.Zero(reflect.TypeOf(v).Elem()))
+	}
+	return nil
+}
+
+// writeJsonAtomic writes v to a temporary file next to path and renames it
+// into place, so readers never see a partially written file.
+func writeJsonAtomic(path string, v interface{}) (err error) {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp.Name(), 0600); err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// updateJson performs a locked read-modify-write of a JSON file. The current
+// file contents are decoded into v, update is called, and v is written back
+// if update doesn't return an error.
+func updateJson(path string, v interface{}, update func() error) error {
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := loadJson(path, v); err != nil {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	return writeJsonAtomic(path, v)
+}
+
+// updateConfig applies a change to the latest on-disk config and saves it.
+// The global config is replaced with the result, so changes made by other
+// processes since this one started are picked up rather than clobbered.
+func updateConfig(update func(c *Config) error) error {
+	var c Config
+	err := updateJson(configFile, &c, func() error {
+		c.Version = ConfigVersion
+		return update(&c)
+	})
+	if err == nil {
+		config = c
+	}
+	return err
+}
+
+// updateCache applies a change to the latest on-disk cache and saves it,
+// replacing the global cache with the result.
+func updateCache(update func(c *Cache) error) error {
+	var c Cache
+	err := updateJson(cacheFile, &c, func() error {
+		c.Version = CacheVersion
+		return update(&c)
+	})
+	if err == nil {
+		cache = c
+	}
+	return err
+}
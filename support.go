@@ -1,19 +1,34 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/jason0x43/alfred-nest/nest"
 	"github.com/jason0x43/go-alfred"
 )
 
 // isAuthorized returns true if this workflow has been authorized with
 // Nest.com.
 func isAuthorized() bool {
-	if config.AccessToken == "" {
+	return hasAuthorization(&config)
+}
+
+// hasAuthorization returns true if a profile's config has a usable token, or
+// its backend doesn't need one.
+func hasAuthorization(c *Config) bool {
+	if !usesAccessToken(c.BackendUrl) {
+		return true
+	}
+	if c.AccessToken == "" {
 		return false
 	}
-	if time.Now().After(config.AccessExpiry) {
+	if time.Now().After(c.AccessExpiry) && c.RefreshToken == "" {
 		return false
 	}
 	return true
@@ -21,38 +36,99 @@ func isAuthorized() bool {
 
 // refresh downloads a user's current account data from Nest.com.
 func refresh() error {
+	if queue, err := loadQueue(); err == nil && len(queue.Writes) > 0 && !isDryRun() {
+		log.Println("Replaying queued changes...")
+		if replayed, err := replayQueue(); err != nil {
+			log.Println("Error replaying queued changes:", err)
+		} else {
+			log.Printf("Replayed %d queued changes", replayed)
+		}
+	}
+
 	log.Println("Getting status...")
-	session := OpenSession(config.AccessToken)
-	data, err := session.GetAllData()
+	backend, err := openBackend()
+	if err != nil {
+		return err
+	}
+	data, err := backend.GetAllData()
 	if err != nil {
 		log.Println("Errror getting status:", err)
+		if err := updateCache(func(c *Cache) error {
+			c.RefreshStarted = time.Time{}
+			c.LastError = err.Error()
+			return nil
+		}); err != nil {
+			log.Println("Error saving cache:", err)
+		}
 		return err
 	}
 
-	cache.AllData = data
-	cache.Time = time.Now()
-	alfred.SaveJson(cacheFile, &cache)
-	configUpdated := false
+	var weather *Weather
+	if provider := weatherProvider(config.WeatherSource); provider != nil {
+		if w, err := provider.Weather(); err != nil {
+			log.Println("Error getting weather:", err)
+		} else {
+			weather = &w
+		}
+	}
 
-	if config.NestId == "" {
-		// if the user hasn't set a default Nest, pick the first one
-		for id, _ := range cache.AllData.Devices.Thermostats {
-			config.NestId = id
-			configUpdated = true
-			break
+	var changes []Change
+	var alerts []string
+	err = updateCache(func(c *Cache) error {
+		if isDryRun() {
+			applySimulatedWrites(&data, c.Simulated)
+		} else {
+			c.Simulated = nil
 		}
+
+		changes = diffAllData(c.AllData, data, config.Scale)
+		c.AllData = data
+		c.Time = time.Now()
+		c.Expired = false
+		c.LastError = ""
+		c.RefreshStarted = time.Time{}
+		alerts = trackEmergencyHeat(c)
+		c.Weather = weather
+		return nil
+	})
+	if err != nil {
+		log.Println("Error saving cache:", err)
+		return err
 	}
+	if err := recordSamples(&data, weather); err != nil {
+		log.Println("Error recording samples:", err)
+	}
+	notifyWebhooks(changes)
+	notifyAlerts(alerts)
 
-	if config.Scale == "" {
-		// if the user hasn't set a scale, use the default Nest's
-		if thermostat, ok := cache.AllData.Devices.Thermostats[config.NestId]; ok {
-			config.Scale = TempScale(thermostat.TemperatureScale)
-			configUpdated = true
+	// catch up on scheduled changes in case the scheduler wasn't running,
+	// e.g. after a restart. The scheduler applies them in its own process, so
+	// they're audited as its changes.
+	if schedule, err := loadSchedule(); err == nil && schedule.HasDueActions() {
+		if err := startScheduler(nil); err != nil {
+			log.Println("Error starting scheduler:", err)
 		}
 	}
 
-	if configUpdated {
-		if err := alfred.SaveJson(configFile, &config); err != nil {
+	if config.NestId == "" || config.Scale == "" {
+		err = updateConfig(func(c *Config) error {
+			if c.NestId == "" {
+				// if the user hasn't set a default Nest, pick the first one
+				for id, _ := range cache.AllData.Devices.Thermostats {
+					c.NestId = id
+					break
+				}
+			}
+
+			if c.Scale == "" {
+				// if the user hasn't set a scale, use the default Nest's
+				if thermostat, ok := cache.AllData.Devices.Thermostats[c.NestId]; ok {
+					c.Scale = nest.TempScale(thermostat.TemperatureScale)
+				}
+			}
+			return nil
+		})
+		if err != nil {
 			log.Printf("Error saving config: %s", err)
 		}
 	}
@@ -60,10 +136,52 @@ func refresh() error {
 	return nil
 }
 
-// checkRefresh refreshes the cache if it hasn't been updated in the last 5
-// minutes.
+// cacheTtl returns how long cached data is considered fresh.
+func cacheTtl() time.Duration {
+	if config.CacheTtl <= 0 {
+		return DefaultCacheTtl * time.Minute
+	}
+	return time.Duration(config.CacheTtl) * time.Minute
+}
+
+// hasCachedData returns true if the cache holds data from a previous refresh.
+func hasCachedData() bool {
+	return !cache.Time.IsZero()
+}
+
+// isCacheStale returns true if the cache is older than the configured TTL or
+// has been explicitly expired by scheduleRefresh.
+func isCacheStale() bool {
+	return cache.Expired || time.Now().Sub(cache.Time) >= cacheTtl()
+}
+
+// checkRefresh makes sure there is data to display. If the cache is stale but
+// usable, the cached data is served as-is and a refresh is started in a
+// background process. The caller only blocks on a refresh if there's no
+// cached data or the cache was expired by a write; even then, a failed refresh
+// falls back to the cached data when there is some.
 func checkRefresh() error {
-	if time.Now().Sub(cache.Time).Minutes() < 5.0 {
+	if !isCacheStale() {
+		return nil
+	}
+
+	if hasCachedData() && !cache.Expired {
+		startBackgroundRefresh()
+		return nil
+	}
+
+	err := checkRefreshNow()
+	if err != nil && hasCachedData() {
+		return nil
+	}
+	return err
+}
+
+// checkRefreshNow refreshes the cache in the current process if it's stale.
+// Long-running servers use this rather than checkRefresh since they keep the
+// cache in memory.
+func checkRefreshNow() error {
+	if !isCacheStale() {
 		return nil
 	}
 
@@ -75,20 +193,167 @@ func checkRefresh() error {
 	return err
 }
 
-// scheduleRefresh schedules a refresh on the next checkRefresh by setting the
-// last update time to zero time.
+// startBackgroundRefresh starts a detached process to refresh the cache,
+// unless one was started recently.
+func startBackgroundRefresh() {
+	// check and mark in one update, so concurrent callers don't both start
+	// a refresh
+	started := false
+	err := updateCache(func(c *Cache) error {
+		if time.Now().Sub(c.RefreshStarted) < backgroundRefreshTimeout {
+			return errors.New("refresh already started")
+		}
+		c.RefreshStarted = time.Now()
+		started = true
+		return nil
+	})
+	if !started {
+		if err != nil {
+			log.Println("Not starting background refresh:", err)
+		}
+		return
+	}
+
+	log.Println("Starting background refresh...")
+	if err := exec.Command(os.Args[0], "do", "refresh").Start(); err != nil {
+		log.Println("Error starting background refresh:", err)
+	}
+}
+
+// scheduleRefresh schedules a refresh on the next checkRefresh by marking the
+// cache as expired. In dry-run mode the cache already reflects the change, so
+// there's nothing to do.
 func scheduleRefresh() error {
-	cache.Time = time.Time{}
-	return alfred.SaveJson(cacheFile, &cache)
+	if isDryRun() {
+		return nil
+	}
+	return updateCache(func(c *Cache) error {
+		c.Expired = true
+		return nil
+	})
 }
 
-// getThermostatByName searches the list of cached thermostats and returns the
-// first one who's name matches a given name.
-func getThermostatByName(name string) (Thermostat, bool) {
-	for _, t := range cache.AllData.Devices.Thermostats {
-		if t.Name == name {
-			return t, true
+// cacheNote describes how current the cached data is. It's empty when the
+// cache is fresh and the last refresh succeeded.
+func cacheNote() string {
+	if !hasCachedData() {
+		return ""
+	}
+
+	var note string
+	if isCacheStale() || cache.LastError != "" {
+		minutes := int(time.Now().Sub(cache.Time).Minutes())
+		switch minutes {
+		case 0:
+			note = tr("as of less than a minute ago")
+		case 1:
+			note = tr("as of 1 minute ago")
+		default:
+			note = tr("as of %d minutes ago", minutes)
 		}
 	}
-	return Thermostat{}, false
+
+	if cache.LastError != "" {
+		note = OfflineMarker + " " + tr("offline") + ", " + note
+	}
+
+	return note
+}
+
+// withCacheNote appends the cache note, if any, to a subtitle.
+func withCacheNote(subtitle string) string {
+	if note := cacheNote(); note != "" {
+		if subtitle == "" {
+			return note
+		}
+		return subtitle + " (" + note + ")"
+	}
+	return subtitle
+}
+
+// getThermostatByName returns the cached thermostat identified by a device ID,
+// alias, name or long name. It fails if no thermostat or more than one
+// thermostat matches.
+func getThermostatByName(name string) (nest.Thermostat, bool) {
+	matches := findThermostats(name, true)
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+	return nest.Thermostat{}, false
+}
+
+// findThermostats returns the cached thermostats matching a name, sorted by
+// device ID. Matches are tried in order of strength, and only the strongest
+// kind that matches anything is returned:
+//
+//  1. device ID
+//  2. user-defined alias (ignoring case)
+//  3. name or long name (ignoring case)
+//  4. fuzzy match on name, long name or alias, if fuzzy is true
+func findThermostats(name string, fuzzy bool) (matches []nest.Thermostat) {
+	thermostats := cache.AllData.Devices.Thermostats
+	name = strings.TrimSpace(name)
+
+	if t, ok := thermostats[name]; ok {
+		return []nest.Thermostat{t}
+	}
+
+	for alias, id := range config.Aliases {
+		if strings.EqualFold(alias, name) {
+			if t, ok := thermostats[id]; ok {
+				return []nest.Thermostat{t}
+			}
+		}
+	}
+
+	var ids []string
+	for id := range thermostats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		t := thermostats[id]
+		if strings.EqualFold(t.Name, name) || strings.EqualFold(t.NameLong, name) {
+			matches = append(matches, t)
+		}
+	}
+	if len(matches) > 0 || !fuzzy {
+		return
+	}
+
+	for _, id := range ids {
+		t := thermostats[id]
+		if alfred.FuzzyMatches(t.Name, name) || alfred.FuzzyMatches(t.NameLong, name) {
+			matches = append(matches, t)
+			continue
+		}
+		for _, alias := range thermostatAliases(id) {
+			if alfred.FuzzyMatches(alias, name) {
+				matches = append(matches, t)
+				break
+			}
+		}
+	}
+	return
+}
+
+// thermostatAliases returns the aliases assigned to a device, sorted.
+func thermostatAliases(deviceId string) (aliases []string) {
+	for alias, id := range config.Aliases {
+		if id == deviceId {
+			aliases = append(aliases, alias)
+		}
+	}
+	sort.Strings(aliases)
+	return
+}
+
+// thermostatKey returns a string that identifies a thermostat in a query: its
+// name if that's unique, or its device ID.
+func thermostatKey(t *nest.Thermostat) string {
+	if len(findThermostats(t.Name, false)) == 1 {
+		return t.Name
+	}
+	return t.DeviceId
 }
@@ -0,0 +1,30 @@
+// sdmserver runs a stand-in for the Smart Device Management API so the SDM
+// backend can be tried offline. Point the workflow at it with
+//
+//	config backend sdm://PROJECT?host=http://localhost:9144
+//
+// No authorization is needed; the stand-in accepts requests without a token.
+//
+// usage: go run support/sdmserver/main.go [project] [address]
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/jason0x43/alfred-nest/internal/sdmfake"
+)
+
+func main() {
+	project, addr := "test-project", "localhost:9144"
+	if len(os.Args) > 1 {
+		project = os.Args[1]
+	}
+	if len(os.Args) > 2 {
+		addr = os.Args[2]
+	}
+
+	log.Printf("Serving fake SDM project %s on http://%s", project, addr)
+	log.Fatal(http.ListenAndServe(addr, sdmfake.NewServer(project)))
+}
@@ -3,10 +3,9 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"strconv"
-	"unicode"
 
+	"github.com/jason0x43/alfred-nest/nest"
 	"github.com/jason0x43/go-alfred"
 )
 
@@ -36,7 +35,7 @@ func (t TempCommand) Items(prefix, query string) (items []alfred.Item, err error
 
 	thermostat, ok := cache.AllData.Devices.Thermostats[config.NestId]
 	if !ok {
-		return items, errors.New("Couldn’t access your default Nest")
+		return items, errors.New(tr("Couldn’t access your default Nest"))
 	}
 
 	temp := thermostat.AmbientTemperature(config.Scale)
@@ -44,18 +43,19 @@ func (t TempCommand) Items(prefix, query string) (items []alfred.Item, err error
 	if query != "" {
 		if newVal, err := strconv.ParseFloat(query, 64); err == nil {
 			if newVal != temp.Value() {
-				newTemp := NewTemp(newVal, config.Scale)
-
-				var changeType string
-				if thermostat.HvacMode == ModeRange {
-					if newTemp.Value() > temp.Value() {
-						changeType = "Heat"
-					} else {
-						changeType = "Cool"
-					}
-				} else {
-					mode := string(thermostat.HvacMode)
-					changeType = string(unicode.ToUpper(rune(mode[0]))) + mode[1:]
+				newTemp := nest.NewTemp(newVal, config.Scale)
+
+				var title, icon string
+				switch {
+				case thermostat.HvacMode == nest.ModeHeat,
+					thermostat.HvacMode == nest.ModeRange && newTemp.Value() > temp.Value():
+					title = tr("Heat to %s", formatTemp(newTemp))
+					icon = IconHeat
+				case thermostat.HvacMode == nest.ModeCool, thermostat.HvacMode == nest.ModeRange:
+					title = tr("Cool to %s", formatTemp(newTemp))
+					icon = IconCool
+				default:
+					title = tr("Set to %s", formatTemp(newTemp))
 				}
 
 				data := tempMessage{
@@ -66,9 +66,10 @@ func (t TempCommand) Items(prefix, query string) (items []alfred.Item, err error
 				dataString, _ := json.Marshal(data)
 
 				items = append(items, alfred.Item{
-					Title:       fmt.Sprintf("%s to %s", changeType, newTemp),
-					SubtitleAll: fmt.Sprintf("Current temperature is %s", temp),
+					Title:       title,
+					SubtitleAll: tr("Current temperature is %s", formatTemp(temp)),
 					Arg:         "temp " + string(dataString),
+					Icon:        icon,
 				})
 				return items, nil
 			}
@@ -77,24 +78,25 @@ func (t TempCommand) Items(prefix, query string) (items []alfred.Item, err error
 
 	var subtitle string
 
-	if thermostat.HvacMode == ModeRange {
+	switch thermostat.HvacMode {
+	case nest.ModeRange:
 		targetHigh := thermostat.TargetTemperatureHigh(config.Scale)
 		targetLow := thermostat.TargetTemperatureLow(config.Scale)
-		subtitle = "Target is "
-		subtitle += fmt.Sprintf("%s to %s", targetLow, targetHigh)
-	} else {
-		if thermostat.HvacMode == ModeHeat {
-			subtitle = "Heating to "
-		} else {
-			subtitle = "Cooling to "
-		}
-		subtitle += thermostat.TargetTemperature(config.Scale).String()
+		subtitle = tr("Target is %s to %s", formatTemp(targetLow), formatTemp(targetHigh))
+	case nest.ModeHeat:
+		subtitle = tr("Heating to %s", formatTemp(thermostat.TargetTemperature(config.Scale)))
+	case nest.ModeCool:
+		subtitle = tr("Cooling to %s", formatTemp(thermostat.TargetTemperature(config.Scale)))
+	default:
+		subtitle = tr("Off")
 	}
 
+	structure := cache.AllData.Structures[thermostat.StructureId]
 	items = append(items, alfred.Item{
 		Title:       subtitle,
-		SubtitleAll: fmt.Sprintf("Current temperature is %s", temp),
+		SubtitleAll: withCacheNote(tr("Current temperature is %s", formatTemp(temp))),
 		Valid:       alfred.Invalid,
+		Icon:        thermostatIcon(&thermostat, &structure),
 	})
 
 	return items, nil
@@ -111,36 +113,81 @@ func (t TempCommand) Do(query string) (out string, err error) {
 		return out, errors.New("Unknown thermostat '" + msg.DeviceId + "'")
 	}
 
-	session := OpenSession(config.AccessToken)
-	var newTemp Temperature
+	mode := msg.Mode
+	if mode == "" {
+		mode = thermostat.HvacMode
+	}
+	if mode == nest.ModeOff {
+		return out, errors.New("Can’t set a target temperature while the Nest is off")
+	}
 
-	if thermostat.HvacMode == ModeRange {
-		if msg.TargetTemp < thermostat.AmbientTemperature(config.Scale).Value() {
-			// If the target temp is less than the ambient temp, we've lowered the high temp
-			newTemp, err = session.SetTargetTemp(msg.DeviceId, msg.Temperature(), TypeHigh)
-		} else if msg.TargetTemp > thermostat.AmbientTemperature(config.Scale).Value() {
-			// If the target temp is greater than the ambient temp, we've raised the low temp
-			newTemp, err = session.SetTargetTemp(msg.DeviceId, msg.Temperature(), TypeLow)
+	hilo := msg.HiLo
+	if hilo == "" {
+		if hilo, err = chooseHiLo(&thermostat, mode, msg.Temperature()); err != nil {
+			return
 		}
-	} else {
-		newTemp, err = session.SetTargetTemp(msg.DeviceId, msg.Temperature(), "")
 	}
 
+	field := nest.TargetTempField(msg.Scale, hilo)
+	change := fieldChange{
+		Target: msg.DeviceId,
+		Name:   thermostat.Name,
+		Field:  field,
+		Path:   nest.ThermostatPath(msg.DeviceId, field),
+		Value:  msg.Temperature(),
+	}
+
+	var newTemp nest.Temperature
+	queued, err := makeChange(change, func(backend nest.ThermostatBackend) (err error) {
+		newTemp, err = backend.SetTargetTemp(msg.DeviceId, msg.Temperature(), hilo)
+		return
+	})
 	if err != nil {
 		return
 	}
+	if queued {
+		return tr("Offline; will set temperature to %s when Nest is reachable",
+			formatTemp(msg.Temperature())), nil
+	}
 
 	scheduleRefresh()
 
-	return fmt.Sprintf("Set temperature to %s", newTemp), err
+	return markSimulated(tr("Set temperature to %s", formatTemp(newTemp))), err
+}
+
+// chooseHiLo returns which target a new temperature should replace. In
+// heat-cool mode, it's the high target if the new temperature is below the
+// ambient temperature and the low target if it's above. In other modes there's
+// only one target.
+func chooseHiLo(thermostat *nest.Thermostat, mode nest.HvacMode, temp nest.Temperature) (nest.HighLow, error) {
+	if mode != nest.ModeRange {
+		return "", nil
+	}
+
+	ambient := thermostat.AmbientTemperature(temp.Scale()).Value()
+	if temp.Value() < ambient {
+		// If the target temp is less than the ambient temp, we've lowered the high temp
+		return nest.TypeHigh, nil
+	} else if temp.Value() > ambient {
+		// If the target temp is greater than the ambient temp, we've raised the low temp
+		return nest.TypeLow, nil
+	}
+	return "", errors.New("Target temperature is the same as the current temperature")
 }
 
 type tempMessage struct {
 	DeviceId   string
 	TargetTemp float64
-	Scale      TempScale
+	Scale      nest.TempScale
+
+	// Mode is the HVAC mode the target applies to, if it's not the mode in
+	// the cache (e.g., because the mode is being changed at the same time).
+	// HiLo selects the high or low target in heat-cool mode, rather than
+	// choosing one based on the ambient temperature.
+	Mode nest.HvacMode `json:",omitempty"`
+	HiLo nest.HighLow  `json:",omitempty"`
 }
 
-func (t *tempMessage) Temperature() Temperature {
-	return NewTemp(t.TargetTemp, t.Scale)
+func (t *tempMessage) Temperature() nest.Temperature {
+	return nest.NewTemp(t.TargetTemp, t.Scale)
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jason0x43/alfred-nest/nest"
+)
+
+// MaxSamples is the number of refresh samples kept, about a week's worth at
+// the default cache TTL.
+const MaxSamples = 2016
+
+const weatherTimeout = 5 * time.Second
+
+// Weather is a reading of outdoor conditions.
+type Weather struct {
+	TemperatureC nest.TempC
+	Humidity     nest.Humidity
+	Time         time.Time
+}
+
+// Temperature returns the outdoor temperature in a given scale.
+func (w *Weather) Temperature(scale nest.TempScale) nest.Temperature {
+	return tempInScale(float64(w.TemperatureC), scale)
+}
+
+// WeatherProvider is a source of outdoor conditions.
+type WeatherProvider interface {
+	Weather() (Weather, error)
+}
+
+// stationReading is the JSON document a weather station provides, e.g.
+//
+//	{"temperature": 54.3, "humidity": 81, "scale": "F", "time": "2017-01-02T15:04:05Z"}
+//
+// Scale defaults to Celsius, and time to when the reading was taken.
+type stationReading struct {
+	Temperature *float64       `json:"temperature"`
+	Humidity    *float64       `json:"humidity"`
+	Scale       nest.TempScale `json:"scale"`
+	Time        time.Time      `json:"time"`
+}
+
+func parseStationReading(data []byte) (weather Weather, err error) {
+	var reading stationReading
+	if err = json.Unmarshal(data, &reading); err != nil {
+		return
+	}
+	if reading.Temperature == nil {
+		return weather, errors.New("Weather station reading has no temperature")
+	}
+
+	tempC := *reading.Temperature
+	if nest.TempScale(strings.ToUpper(string(reading.Scale))) == nest.ScaleF {
+		tempC = fToC(tempC)
+	}
+	weather.TemperatureC = nest.TempC(tempC)
+
+	if reading.Humidity != nil {
+		weather.Humidity = nest.Humidity(*reading.Humidity)
+	}
+
+	weather.Time = reading.Time
+	if weather.Time.IsZero() {
+		weather.Time = time.Now()
+	}
+	return
+}
+
+// fileWeather reads a weather station's JSON output from a local file.
+type fileWeather struct {
+	path string
+}
+
+func (f fileWeather) Weather() (Weather, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return Weather{}, err
+	}
+	return parseStationReading(data)
+}
+
+// httpWeather fetches a weather station's JSON output from an HTTP endpoint,
+// typically on the local network.
+type httpWeather struct {
+	url string
+}
+
+func (h httpWeather) Weather() (Weather, error) {
+	client := http.Client{Timeout: weatherTimeout}
+	resp, err := client.Get(h.url)
+	if err != nil {
+		return Weather{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Weather{}, errors.New("Weather station returned " + resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Weather{}, err
+	}
+	return parseStationReading(data)
+}
+
+// weatherProvider returns the provider for a configured weather source, which
+// is either an HTTP(S) URL or a file path. It returns nil if there's no
+// source.
+func weatherProvider(source string) WeatherProvider {
+	switch {
+	case source == "":
+		return nil
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		return httpWeather{url: source}
+	default:
+		return fileWeather{path: source}
+	}
+}
+
+// Sample records indoor and outdoor conditions for a thermostat at the time of
+// a refresh.
+type Sample struct {
+	Time            time.Time
+	DeviceId        string
+	TemperatureC    nest.TempC
+	Humidity        nest.Humidity
+	OutdoorC        *nest.TempC    `json:",omitempty"`
+	OutdoorHumidity *nest.Humidity `json:",omitempty"`
+}
+
+type Samples struct {
+	Samples []Sample
+}
+
+// recordSamples appends a sample for every thermostat in data. Outdoor
+// conditions are included if weather is non-nil.
+func recordSamples(data *nest.AllData, weather *Weather) error {
+	now := time.Now()
+	var samples Samples
+	return updateJson(samplesFile, &samples, func() error {
+		for id, t := range data.Devices.Thermostats {
+			sample := Sample{
+				Time:         now,
+				DeviceId:     id,
+				TemperatureC: t.AmbientTemperatureC,
+				Humidity:     t.Humidity,
+			}
+			if weather != nil {
+				outdoorC, outdoorHumidity := weather.TemperatureC, weather.Humidity
+				sample.OutdoorC = &outdoorC
+				sample.OutdoorHumidity = &outdoorHumidity
+			}
+			samples.Samples = append(samples.Samples, sample)
+		}
+		if len(samples.Samples) > MaxSamples {
+			samples.Samples = samples.Samples[len(samples.Samples)-MaxSamples:]
+		}
+		return nil
+	})
+}
+
+// outdoorSummary describes outdoor conditions in a few words.
+func outdoorSummary(weather *Weather, scale nest.TempScale) string {
+	if weather.Humidity > 0 {
+		return tr("Outdoor: %s, %s", formatTemp(weather.Temperature(scale)),
+			formatHumidity(weather.Humidity))
+	}
+	return tr("Outdoor: %s", formatTemp(weather.Temperature(scale)))
+}
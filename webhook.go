@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Nest-Signature"
+	webhookAttempts = 4
+	webhookBackoff  = time.Second
+	webhookTimeout  = 10 * time.Second
+)
+
+// Webhook is an HTTP endpoint that receives a POST whenever a refresh detects
+// a state change. If Secret is set, the body is signed with HMAC-SHA256 and the
+// hex digest is sent in the X-Nest-Signature header as "sha256=<digest>".
+type Webhook struct {
+	Url    string
+	Secret string `json:",omitempty"`
+}
+
+type webhookPayload struct {
+	Time    time.Time `json:"time"`
+	Changes []Change  `json:"changes,omitempty"`
+	Alerts  []string  `json:"alerts,omitempty"`
+}
+
+// notifyWebhooks sends a set of changes to the webhooks.
+func notifyWebhooks(changes []Change) {
+	if len(changes) > 0 {
+		sendWebhooks(webhookPayload{Time: time.Now(), Changes: changes})
+	}
+}
+
+// sendWebhooks hands a payload off to a detached process so that the calling
+// command isn't held up by slow or failing endpoints.
+func sendWebhooks(payload webhookPayload) {
+	if len(config.Webhooks) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Error encoding webhook payload:", err)
+		return
+	}
+
+	if err := exec.Command(os.Args[0], "do", "webhook "+string(data)).Start(); err != nil {
+		log.Println("Error starting webhook process:", err)
+	}
+}
+
+// webhook -----------------------------------------------
+
+type WebhookCommand struct{}
+
+func (c WebhookCommand) Keyword() string {
+	return "webhook"
+}
+
+func (c WebhookCommand) IsEnabled() bool {
+	return true
+}
+
+// Do POSTs a JSON payload to every configured webhook.
+func (c WebhookCommand) Do(query string) (string, error) {
+	body := []byte(query)
+	var lastErr error
+
+	for _, hook := range config.Webhooks {
+		if err := postWebhook(hook, body); err != nil {
+			log.Printf("Error posting to webhook %s: %s", hook.Url, err)
+			lastErr = err
+		}
+	}
+
+	return "", lastErr
+}
+
+// postWebhook sends a payload to a webhook, retrying with exponential backoff
+// on network errors and 5xx responses.
+func postWebhook(hook Webhook, body []byte) (err error) {
+	webhookClient := &http.Client{Timeout: webhookTimeout}
+	delay := webhookBackoff
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		var request *http.Request
+		if request, err = http.NewRequest("POST", hook.Url, bytes.NewReader(body)); err != nil {
+			return
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if hook.Secret != "" {
+			request.Header.Set(SignatureHeader, "sha256="+signWebhook(hook.Secret, body))
+		}
+
+		var resp *http.Response
+		if resp, err = webhookClient.Do(request); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf(resp.Status)
+			if resp.StatusCode < 500 {
+				// client errors won't be fixed by retrying
+				return
+			}
+		}
+
+		if attempt < webhookAttempts {
+			log.Printf("Webhook attempt %d failed (%s), retrying in %v", attempt, err, delay)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+
+	return
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}